@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// Aliases give transfers human friendly names. They are kept in a small stream
+// used as a registry, with one message per alias holding the stream name.
+// Each -prefix has a registry of its own.
+const (
+	aliasStream     = "NJS_XFER_ALIASES"
+	aliasSubjPrefix = "njs-xfer.alias."
+)
+
+// aliasRegistry returns the registry stream and the prefix of its subjects.
+func aliasRegistry() (string, string) {
+	return withPrefix(aliasStream), withSubjectPrefix(aliasSubjPrefix)
+}
+
+// aliasEntry is the stream an alias refers to, and the registry messages holding it.
+type aliasEntry struct {
+	stream string
+	seqs   []uint64
+}
+
+func validAlias(alias string) bool {
+	return alias != "" && !strings.ContainsAny(alias, ".*> \t\r\n")
+}
+
+// loadAliases reads all of the aliases from the registry.
+func loadAliases(js nats.JetStreamContext) (map[string]*aliasEntry, error) {
+	registry, subjPrefix := aliasRegistry()
+	aliases := make(map[string]*aliasEntry)
+	si, err := xfer.LookupStream(js, registry)
+	if err == xfer.ErrStreamNotFound {
+		return aliases, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if si.State.Msgs == 0 {
+		return aliases, nil
+	}
+	for seq := si.State.FirstSeq; seq <= si.State.LastSeq; seq++ {
+		m, err := js.GetMsg(registry, seq)
+		if err != nil {
+			// Removed aliases leave holes in the registry.
+			if err.Error() == "no message found" {
+				continue
+			}
+			return nil, err
+		}
+		alias := strings.TrimPrefix(m.Subject, subjPrefix)
+		ae := aliases[alias]
+		if ae == nil {
+			ae = &aliasEntry{}
+			aliases[alias] = ae
+		}
+		ae.stream = string(m.Data)
+		ae.seqs = append(ae.seqs, seq)
+	}
+	return aliases, nil
+}
+
+// checkAlias makes sure the alias is valid and not in use by a different stream.
+func checkAlias(js nats.JetStreamContext, alias, stream string) error {
+	if !validAlias(alias) {
+		return fmt.Errorf("invalid alias %q", alias)
+	}
+	aliases, err := loadAliases(js)
+	if err != nil {
+		return err
+	}
+	if ae := aliases[alias]; ae != nil && ae.stream != stream {
+		return fmt.Errorf("alias %q already refers to stream %q", alias, ae.stream)
+	}
+	return nil
+}
+
+// setAlias points the alias at the stream, creating the registry if needed.
+func setAlias(js nats.JetStreamContext, alias, stream string) error {
+	if err := checkAlias(js, alias, stream); err != nil {
+		return err
+	}
+	registry, subjPrefix := aliasRegistry()
+	if _, err := xfer.LookupStream(js, registry); err == xfer.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     registry,
+			Subjects: []string{subjPrefix + "*"},
+		})
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err := js.Publish(subjPrefix+alias, []byte(stream))
+	return err
+}
+
+// removeAlias removes the alias from the registry.
+func removeAlias(js nats.JetStreamContext, alias string) error {
+	aliases, err := loadAliases(js)
+	if err != nil {
+		return err
+	}
+	ae := aliases[alias]
+	if ae == nil {
+		return fmt.Errorf("alias %q not found", alias)
+	}
+	registry, _ := aliasRegistry()
+	for _, seq := range ae.seqs {
+		if err := js.DeleteMsg(registry, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveStream returns the stream for name, which is either an alias or
+// a file name that maps to a stream via canonicalName, or legacyName for
+// transfers put by earlier versions.
+func resolveStream(js nats.JetStreamContext, name string) (string, error) {
+	if validAlias(name) {
+		aliases, err := loadAliases(js)
+		if err != nil {
+			return "", err
+		}
+		if ae := aliases[name]; ae != nil {
+			return ae.stream, nil
+		}
+	}
+	stream := canonicalName(name)
+	if legacy := legacyName(name); legacy != stream {
+		if _, err := xfer.LookupStream(js, stream); err == xfer.ErrStreamNotFound {
+			if _, err := xfer.LookupStream(js, legacy); err == nil {
+				return legacy, nil
+			}
+		}
+	}
+	return stream, nil
+}
+
+// aliasCommand handles the alias management commands.
+func aliasCommand(nc *nats.Conn, args []string) error {
+	js := newJetStream(nc)
+	switch args[0] {
+	case "ls":
+		aliases, err := loadAliases(js)
+		if err != nil {
+			return fmt.Errorf("error loading aliases: %v", err)
+		}
+		names := make([]string, 0, len(aliases))
+		for alias := range aliases {
+			names = append(names, alias)
+		}
+		sort.Strings(names)
+		for _, alias := range names {
+			fmt.Printf("%s\t%s\n", alias, aliases[alias].stream)
+		}
+	case "rm":
+		if len(args) < 2 {
+			showUsageAndExit(1)
+		}
+		if err := removeAlias(js, args[1]); err != nil {
+			return fmt.Errorf("error removing alias: %v", err)
+		}
+	default:
+		showUsageAndExit(1)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// listChunks prints every message in a transfer's stream, one per line, with its
+// sequence, size and chunk index, noting anything that would trouble a get,
+// such as holes in the stream, chunks out of order, or short chunks that are
+// not the last.
+func listChunks(nc *nats.Conn, name string) error {
+	js := newJetStream(nc)
+
+	stream, err := resolveStream(js, name)
+	if err != nil {
+		return fmt.Errorf("error resolving %q: %v", name, err)
+	}
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil {
+		log.Printf("Error reading metadata for stream %q: %v", stream, err)
+	}
+	chunkSize := 0
+	if tm != nil {
+		chunkSize = tm.ChunkSize
+	}
+
+	fmt.Printf("seq\tsize\tindex\tnotes\n")
+	problems, nextIndex, short := 0, 0, uint64(0)
+	for seq := si.State.FirstSeq; seq <= si.State.LastSeq && si.State.Msgs > 0; seq++ {
+		m, err := js.GetMsg(stream, seq)
+		if err != nil {
+			if err.Error() == "no message found" {
+				fmt.Printf("%d\t-\t-\tmissing\n", seq)
+				problems++
+				continue
+			}
+			return fmt.Errorf("error reading sequence %d: %v", seq, err)
+		}
+		if m.Header.Get(xfer.HeaderMeta) != "" {
+			note := "trailer"
+			if seq != si.State.LastSeq {
+				note = "superseded trailer"
+			}
+			fmt.Printf("%d\t%d\t-\t%s\n", seq, len(m.Data), note)
+			continue
+		}
+		// Each file of a directory transfer ends with its own short chunk.
+		if e := m.Header.Get(xfer.HeaderEntry); e != "" {
+			fmt.Printf("%d\t%d\t-\t%s %s\n", seq, len(m.Data), e, m.Header.Get(xfer.HeaderPath))
+			short = 0
+			continue
+		}
+
+		var notes []string
+		data, err := decrypter.ChunkData(m.Header, m.Data)
+		if err != nil {
+			notes = append(notes, err.Error())
+			problems++
+		} else if c := m.Header.Get(xfer.HeaderCompression); c != "" {
+			notes = append(notes, fmt.Sprintf("%s %d stored", c, len(m.Data)))
+		}
+		// Without metadata we assume the first chunk is full size.
+		if chunkSize == 0 {
+			chunkSize = len(data)
+		}
+		if short != 0 {
+			notes = append(notes, fmt.Sprintf("follows short chunk %d", short))
+			problems++
+		}
+		if len(data) > chunkSize {
+			notes = append(notes, fmt.Sprintf("larger than chunk size %d", chunkSize))
+			problems++
+		} else if len(data) < chunkSize && short == 0 {
+			short = seq
+		}
+		index := "-"
+		if i := xfer.HeaderInt(m.Header, xfer.HeaderChunkIndex); i >= 0 {
+			index = strconv.Itoa(i)
+			if i != nextIndex {
+				notes = append(notes, fmt.Sprintf("expected index %d", nextIndex))
+				problems++
+			}
+			nextIndex = i + 1
+		} else {
+			nextIndex++
+		}
+		fmt.Printf("%d\t%d\t%s\t%s\n", seq, len(data), index, strings.Join(notes, ", "))
+	}
+	if tm == nil {
+		infof("Stream %q has no transfer metadata", stream)
+	}
+	if problems > 0 {
+		log.Printf("Found %d problems in stream %q", problems, stream)
+	}
+	return nil
+}
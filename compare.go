@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// compareFile reports whether a local file matches a stored transfer, returning
+// an integrity error if it does not. By default only the size and digest
+// in the metadata are compared. With deep the stored chunks are compared with
+// the file byte for byte, which also works for streams without metadata.
+func compareFile(nc *nats.Conn, fileName, name string, deep bool) error {
+	js := newJetStream(nc)
+
+	stream, err := resolveStream(js, name)
+	if err != nil {
+		return fmt.Errorf("error resolving %q: %v", name, err)
+	}
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil {
+		return fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+	}
+	if tm != nil && tm.Ref != "" {
+		if si, tm, err = xfer.LookupRef(js, tm); err != nil {
+			return fmt.Errorf("error following %q to stream %q: %v", stream, tm.Ref, err)
+		}
+		stream = si.Config.Name
+	}
+	if tm == nil && !deep {
+		return fmt.Errorf("stream %q has no transfer metadata, use -deep to compare its contents", stream)
+	}
+	if deep && xfer.IsParallel(si) {
+		return fmt.Errorf("stream %q holds a parallel transfer, which can only be compared by digest", stream)
+	}
+
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %v", fileName, err)
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %q: %v", fileName, err)
+	}
+
+	differ := func(format string, args ...interface{}) error {
+		return &xfer.IntegrityError{Msg: fmt.Sprintf(format, args...)}
+	}
+	if tm != nil && fi.Size() != tm.Size {
+		return differ("%q differs from %q, size is %d bytes but stored size is %d", fileName, stream, fi.Size(), tm.Size)
+	}
+
+	if !deep {
+		digest, err := fileDigest(fileName)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %v", fileName, err)
+		}
+		if digest != tm.Digest {
+			return differ("%q differs from %q, the SHA-256 digests do not match", fileName, stream)
+		}
+		infof("%q matches %q", fileName, stream)
+		return nil
+	}
+
+	// Compare the chunks as they arrive with the same range of the file.
+	last := si.State.LastSeq
+	if tm != nil {
+		last--
+	}
+	var offset int64
+	buf := make([]byte, 0, xfer.DefaultChunkSize)
+	if si.State.Msgs > 0 && si.State.FirstSeq <= last {
+		sub, err := js.SubscribeSync(
+			si.Config.Subjects[0],
+			nats.AckNone(),
+			nats.DeliverAll(),
+			nats.EnableFlowControl(),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating consumer: %v", err)
+		}
+		defer sub.Unsubscribe()
+
+		for eseq := si.State.FirstSeq; eseq <= last; eseq++ {
+			m, err := sub.NextMsg(5 * time.Second)
+			if err != nil {
+				return fmt.Errorf("error reading stream %q: %v", stream, err)
+			}
+			meta, err := m.Metadata()
+			if err != nil {
+				return err
+			}
+			if seq := meta.Sequence.Stream; seq != eseq {
+				return &xfer.IntegrityError{Msg: fmt.Sprintf("missing chunk in stream %q, expected sequence %d but got %d", stream, eseq, seq)}
+			}
+			// Skip trailers superseded by recover.
+			if m.Header.Get(xfer.HeaderMeta) != "" {
+				continue
+			}
+			data, err := decrypter.ChunkData(m.Header, m.Data)
+			if err != nil {
+				return fmt.Errorf("error reading chunk %d of %q: %w", eseq, stream, err)
+			}
+			if cap(buf) < len(data) {
+				buf = make([]byte, 0, len(data))
+			}
+			buf = buf[:len(data)]
+			n, err := io.ReadFull(fd, buf)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return fmt.Errorf("error reading %q: %v", fileName, err)
+			}
+			if !bytes.Equal(buf[:n], data[:n]) {
+				for i := range buf[:n] {
+					if buf[i] != data[i] {
+						return differ("%q differs from %q, first at offset %d", fileName, stream, offset+int64(i))
+					}
+				}
+			}
+			if n < len(data) {
+				return differ("%q differs from %q, the file ends at offset %d before the stored data", fileName, stream, offset+int64(n))
+			}
+			offset += int64(n)
+		}
+	}
+	if offset < fi.Size() {
+		return differ("%q differs from %q, the stored data ends at offset %d before the file", fileName, stream, offset)
+	}
+	infof("%q matches %q", fileName, stream)
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseExtList parses a comma separated list of file extensions, e.g. ".txt,.log".
+// The extensions are returned lower cased.
+func parseExtList(list string) ([]string, error) {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext[1:], "./\\ \t") {
+			return nil, fmt.Errorf("invalid extension %q, expected e.g. .txt", ext)
+		}
+		exts = append(exts, ext)
+	}
+	return exts, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables that stand in for connection flags, as for the
+// nats CLI.
+const (
+	urlEnv     = "NATS_URL"
+	credsEnv   = "NATS_CREDS"
+	contextEnv = "NATS_CONTEXT"
+)
+
+// applyEnv uses the environment for -s, -creds and -context when they were
+// not given on the command line, as if they had been, so a context only
+// fills in what neither sets. Credentials are taken from the environment
+// only when no authentication was given.
+func applyEnv() error {
+	auth := flagSet("creds") || flagSet("nkey") || flagSet("token")
+	settings := []struct {
+		flag, env string
+		auth      bool
+	}{
+		{"s", urlEnv, false},
+		{"creds", credsEnv, true},
+		{"context", contextEnv, false},
+	}
+	for _, s := range settings {
+		value := os.Getenv(s.env)
+		if value == "" || flagSet(s.flag) || (s.auth && auth) {
+			continue
+		}
+		if s.auth {
+			value = expandHome(value)
+		}
+		if err := flag.Set(s.flag, value); err != nil {
+			return fmt.Errorf("%s: %v", s.env, err)
+		}
+	}
+	return nil
+}
+
+// natsContext holds the connection settings of a nats CLI context, which is
+// kept as JSON in ~/.config/nats/context/<name>.json.
+type natsContext struct {
+	URL      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Creds    string `json:"creds"`
+	NKey     string `json:"nkey"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	CA       string `json:"ca"`
+	Domain   string `json:"jetstream_domain"`
+}
+
+// contextPath returns the file for the named context. A name that looks
+// like a path is used as is.
+func contextPath(name string) (string, error) {
+	if strings.ContainsRune(name, os.PathSeparator) || strings.HasSuffix(name, ".json") {
+		return name, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "nats", "context", name+".json"), nil
+}
+
+// loadContext reads the named context.
+func loadContext(name string) (*natsContext, error) {
+	path, err := contextPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nctx natsContext
+	if err := json.Unmarshal(data, &nctx); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", path, err)
+	}
+	return &nctx, nil
+}
+
+// applyContext uses the settings of the named context for any connection
+// flags that were not given on the command line. Authentication is taken
+// from the context only when none was given.
+func applyContext(name string) error {
+	nctx, err := loadContext(name)
+	if err != nil {
+		return err
+	}
+	if nctx.User != "" {
+		infof("Warning: context %q uses a user and password, which are not supported, use creds, an nkey or a token", name)
+	}
+	auth := flagSet("creds") || flagSet("nkey") || flagSet("token")
+	settings := []struct {
+		flag, value string
+		auth        bool
+	}{
+		{"s", nctx.URL, false},
+		{"creds", expandHome(nctx.Creds), true},
+		{"nkey", expandHome(nctx.NKey), true},
+		{"token", nctx.Token, true},
+		{"tlscert", expandHome(nctx.Cert), false},
+		{"tlskey", expandHome(nctx.Key), false},
+		{"tlsca", expandHome(nctx.CA), false},
+		{"domain", nctx.Domain, false},
+	}
+	for _, s := range settings {
+		if s.value == "" || flagSet(s.flag) || (s.auth && auth) {
+			continue
+		}
+		if err := flag.Set(s.flag, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandHome expands a leading ~ in path, as the nats CLI allows in contexts.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// copyWindow is how many copied messages may await their acknowledgement.
+const copyWindow = 256
+
+// copyTransfer copies the transfer named from, an alias, file or stream
+// name, into a new stream called to, possibly on another server. Messages
+// are republished in order with their headers, so the copy holds the same
+// chunks and metadata and can be retrieved with get as usual.
+func copyTransfer(ctx context.Context, srcConn, dstConn *nats.Conn, from, to string, keepPartial bool) error {
+	src, dst := newJetStream(srcConn), newJetStream(dstConn)
+
+	stream, err := resolveStream(src, from)
+	if err != nil {
+		return fmt.Errorf("error resolving %q: %v", from, err)
+	}
+	si, err := xfer.LookupStream(src, stream)
+	if err == xfer.ErrStreamNotFound {
+		return fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	if ok, err := xfer.IsTransfer(src, si); err != nil {
+		return fmt.Errorf("error checking stream %q: %v", stream, err)
+	} else if !ok {
+		return fmt.Errorf("stream %q was not created by njs-xfer, not copying it", stream)
+	}
+	// A reference holds no chunks, and the stream it refers to may not
+	// exist where the copy goes.
+	if tm, err := xfer.LookupMeta(src, si); err != nil {
+		return fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+	} else if tm != nil && tm.Ref != "" {
+		return fmt.Errorf("stream %q refers to stream %q, copy that instead", stream, tm.Ref)
+	}
+	if _, err := dst.StreamInfo(to); err == nil {
+		return fmt.Errorf("stream %q %w", to, xfer.ErrExists)
+	}
+
+	// The copy gets a subject of its own, in our namespace like put's.
+	subj := nats.NewInbox()
+	if streamPrefix != "" {
+		subj = withSubjectPrefix(strings.Replace(subj, nats.InboxPrefix, "inbox.", 1))
+	}
+	// A parallel transfer keeps its regions on subjects of their own.
+	subjects := []string{subj}
+	if xfer.IsParallel(si) {
+		subjects[0] = subj + ".>"
+	}
+	if _, err := dst.AddStream(&nats.StreamConfig{
+		Name:       to,
+		Subjects:   subjects,
+		Storage:    si.Config.Storage,
+		Replicas:   si.Config.Replicas,
+		MaxAge:     si.Config.MaxAge,
+		Duplicates: si.Config.Duplicates,
+	}); err != nil {
+		return fmt.Errorf("error creating stream %q: %v", to, err)
+	}
+
+	// The stream's size includes headers, so we can not tell how far along
+	// we are from the chunks.
+	pr := startProgress("Copied", 0, 0)
+	defer pr.stop()
+	start := time.Now()
+	n, err := copyMessages(ctx, src, dst, si, subj, pr.add)
+	if err != nil {
+		pr.stop()
+		if !keepPartial {
+			discardStream(dst, to, false)
+		}
+		return err
+	}
+	pr.stop()
+	infof("Copied %d messages, %v, from %q to %q in %v",
+		n, friendlyBytes(int(si.State.Bytes)), stream, to, time.Since(start))
+	return nil
+}
+
+// copyMessages republishes every message of the source stream on subj, or
+// below it for a parallel transfer, and returns how many there were once all
+// have been acknowledged.
+func copyMessages(ctx context.Context, src, dst nats.JetStreamContext, si *nats.StreamInfo, subj string, progress func(n int)) (int, error) {
+	sub, err := src.SubscribeSync(
+		si.Config.Subjects[0],
+		nats.AckNone(),
+		nats.DeliverAll(),
+		nats.EnableFlowControl(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error creating consumer: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// The subjects of a parallel transfer's regions keep their suffix.
+	var base string
+	if xfer.IsParallel(si) {
+		base = strings.TrimSuffix(si.Config.Subjects[0], ">")
+	}
+
+	var pending []nats.PubAckFuture
+	// wait waits for acknowledgements until at most max are outstanding.
+	wait := func(max int) error {
+		for len(pending) > max {
+			select {
+			case <-pending[0].Ok():
+			case err := <-pending[0].Err():
+				return fmt.Errorf("error copying message: %v", err)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			pending = pending[1:]
+		}
+		return nil
+	}
+
+	n := 0
+	for n < int(si.State.Msgs) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		m, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			return 0, fmt.Errorf("error reading stream %q: %v", si.Config.Name, err)
+		}
+		cm := nats.NewMsg(subj)
+		if base != "" {
+			cm.Subject = subj + "." + strings.TrimPrefix(m.Subject, base)
+		}
+		for k, v := range m.Header {
+			cm.Header[k] = v
+		}
+		cm.Data = m.Data
+		paf, err := dst.PublishMsgAsync(cm)
+		if err != nil {
+			return 0, fmt.Errorf("error copying message: %v", err)
+		}
+		pending = append(pending, paf)
+		if err := wait(copyWindow); err != nil {
+			return 0, err
+		}
+		progress(len(m.Data))
+		n++
+	}
+	if err := wait(0); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -2,4 +2,8 @@ module github.com/derekcollison/njs-xfer
 
 go 1.16
 
-require github.com/nats-io/nats.go v1.10.1-0.20210409153801-b8530c789d0b // indirect
+require (
+	github.com/nats-io/nats-server/v2 v2.2.2
+	github.com/nats-io/nats.go v1.10.1-0.20210419223411-20527524c393
+	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b
+)
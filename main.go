@@ -1,225 +1,2226 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/derekcollison/njs-xfer/xfer"
 	"github.com/nats-io/nats.go"
 )
 
 func usage() {
-	log.Printf("Usage: njs-xfer [-s server] [-creds file] <put|get> <file|stream>\n")
+	log.Printf("Usage: njs-xfer [-s server] [auth] <put|get> <file|stream>...\n")
+	log.Printf("       njs-xfer [-s server] [auth] ensure <file>\n")
+	log.Printf("       njs-xfer [-s server] [auth] -name stream get\n")
+	log.Printf("       njs-xfer [-s server] [auth] list\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-json] ping\n")
+	log.Printf("       njs-xfer [-s server] [auth] list-chunks <file|stream>\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-deep] compare <local-file> <file|stream>\n")
+	log.Printf("       njs-xfer [-s server] [auth] alias <ls|rm> [alias]\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-s2 server] copy <file|stream> <stream>\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-y] rm <-all|file|stream>...\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-name file] [-chunk size] recover <stream>\n")
+	log.Printf("       njs-xfer [-s server] [auth] [-checkpoint file] [-strict-metadata] verify <file|stream>\n")
+	log.Printf("\nAuth is one of -creds file, -nkey file or -token token.\n")
+	log.Printf("Connection settings come first from flags, then %s and %s, then the context from\n", urlEnv, credsEnv)
+	log.Printf("-context or %s, and otherwise the defaults.\n", contextEnv)
+	log.Printf("TLS is configured with -tlscert file -tlskey file, -tlsca file and -tls-skip-verify.\n")
+	log.Printf("\nExit codes:\n")
+	log.Printf("  %d  success\n", exitOK)
+	log.Printf("  %d  any other error, such as failing to connect\n", exitError)
+	log.Printf("  %d  stream not found\n", exitNotFound)
+	log.Printf("  %d  integrity check failed, e.g. a missing chunk or digest mismatch\n", exitIntegrity)
+	log.Printf("  %d  destination conflict, a file or stream already exists\n", exitConflict)
+	log.Printf("  %d  interrupted\n", exitInterrupted)
 	flag.PrintDefaults()
 }
 
+// Exit codes, so scripts can tell categories of failure apart.
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitNotFound  = 2
+	exitIntegrity = 3
+	exitConflict  = 4
+	// As for a shell command killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// exitCode maps an error from a command to our exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, xfer.ErrStreamNotFound):
+		return exitNotFound
+	case errors.Is(err, xfer.ErrIntegrity):
+		return exitIntegrity
+	case errors.Is(err, xfer.ErrExists):
+		return exitConflict
+	}
+	var ce *commandError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return exitError
+}
+
+// exit reports the error, if any, and exits with its code once the
+// connection is closed.
+func exit(nc *nats.Conn, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Print("Interrupted")
+	} else if err != nil {
+		msg := err.Error()
+		log.Print(strings.ToUpper(msg[:1]) + msg[1:])
+	}
+	nc.Close()
+	os.Exit(exitCode(err))
+}
+
+// interruptContext returns a context that is cancelled on the first interrupt
+// or termination signal, so a transfer can stop and clean up after itself.
+// A second signal exits straight away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		status.update("Interrupted, stopping")
+		cancel()
+		<-sigCh
+		os.Exit(exitInterrupted)
+	}()
+	return ctx
+}
+
+// connClosed is closed once the connection is closed for good, e.g. after
+// running out of reconnect attempts, see setupConnOptions.
+var (
+	connClosed     = make(chan struct{})
+	connClosedOnce sync.Once
+)
+
+// closedContext is done when its parent is, or once the connection is closed
+// for good, with nats.ErrConnectionClosed as its error. A transfer then stops
+// straight away instead of waiting out its timeouts.
+type closedContext struct {
+	context.Context
+	done chan struct{}
+	mu   sync.Mutex
+	err  error
+}
+
+func withConnClosed(parent context.Context) context.Context {
+	cc := &closedContext{Context: parent, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-parent.Done():
+			cc.cancel(parent.Err())
+		case <-connClosed:
+			cc.cancel(nats.ErrConnectionClosed)
+		}
+	}()
+	return cc
+}
+
+func (cc *closedContext) cancel(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.err == nil {
+		cc.err = err
+		close(cc.done)
+	}
+}
+
+func (cc *closedContext) Done() <-chan struct{} {
+	return cc.done
+}
+
+func (cc *closedContext) Err() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
+
+// connLost reports whether ctx is done because the connection closed, which
+// leaves the stream as it was, so a transfer can be continued later.
+func connLost(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), nats.ErrConnectionClosed)
+}
+
 func showUsageAndExit(exitcode int) {
 	usage()
 	os.Exit(exitcode)
 }
 
 func main() {
-	var urls = flag.String("s", nats.DefaultURL, "The nats server URLs (separated by comma)")
-	var creds = flag.String("creds", "", "User Credentials File")
+	var urls = flag.String("s", nats.DefaultURL, "The nats server URLs (separated by comma), "+urlEnv+" is used if not given")
+	var urls2 = flag.String("s2", "", "The nats server URLs to copy to, with the same auth and TLS settings, if not the same servers")
+	var natsCtx = flag.String("context", "", "Name of, or path to, a nats CLI context to connect with, "+contextEnv+" is used if not given. Flags given explicitly override its settings")
+	var creds = flag.String("creds", "", "User Credentials File, "+credsEnv+" is used if no authentication is given")
+	var nkey = flag.String("nkey", "", "NKey Seed File")
+	var token = flag.String("token", "", "Authentication Token")
+	var tlsCert = flag.String("tlscert", "", "TLS Client Certificate File")
+	var tlsKey = flag.String("tlskey", "", "TLS Client Key File")
+	var tlsCA = flag.String("tlsca", "", "TLS CA Certificate File to verify the server with")
+	var tlsSkipVerify = flag.Bool("tls-skip-verify", false, "Do not verify the server's TLS certificate, which is insecure and only for testing")
+	var strictMeta = flag.Bool("strict-metadata", false, "Refuse to get or verify streams without complete transfer metadata")
+	var fsync = flag.String("fsync", fsyncFinal, "When to fsync the file on get (always, final, never)")
+	var writeBuf = flag.String("write-buffer", "0", "Size of the write buffer for the file on get, e.g. 256k (0 disables)")
+	var alias = flag.String("alias", "", "Alias to refer to the transfer by on put")
+	var waitDurable = flag.Bool("wait-durable", false, "Wait for all stream replicas to be current before completing put")
+	var subjFromHash = flag.Bool("subject-from-hash", false, "Derive the stream subject from a hash of the stream name instead of a random inbox on put")
+	var fromList = flag.String("from-list", "", "File with a list of files to put, one per line (- for stdin)")
+	var nullSep = flag.Bool("0", false, "Files in the -from-list file are separated by null characters")
+	var limitStreams = flag.Int("limit-streams", 0, "Maximum number of streams a put may create (0 is no limit)")
+	var follow = flag.Bool("follow", false, "Keep transferring as the file grows on put, or as the stream grows on get")
+	var maxDuration = flag.Duration("max-duration", 0, "Maximum time to follow a growing file on put (0 is until interrupted)")
+	var replay = flag.String("replay", "instant", "Replay policy for get, instant or original to deliver chunks at the rate they were published")
+	var mode = flag.String("mode", xfer.ConsumerFlow, "Consumer for get, flow for pushed chunks under flow control or pull to fetch them with explicit acks")
+	var maxAckPending = flag.Int("max-ack-pending", xfer.DefaultMaxAckPending, "Chunks get may have unacknowledged at once with -mode pull")
+	var sinceSeq = flag.Uint64("since-seq", 0, "First stream sequence to retrieve on get")
+	var untilSeq = flag.Uint64("until-seq", 0, "Last stream sequence to retrieve on get")
+	var offset = flag.Int64("offset", 0, "First byte of the file to retrieve on get")
+	var length = flag.Int64("length", 0, "Number of bytes of the file to retrieve on get, starting at -offset (0 is to the end)")
+	var sortBy = flag.String("sort", "name", "Sort list by name, size or date")
+	var reverse = flag.Bool("reverse", false, "Reverse the list order")
+	var limit = flag.Int("limit", 0, "Only list the first N transfers (0 is all)")
+	var verify = flag.String("verify", xfer.VerifyFull, "Integrity checks on get: full for sequence, size and digest, gap to skip the digest, or none")
+	var replicas int
+	flag.IntVar(&replicas, "replicas", 1, "Number of replicas for the streams put creates, 1 to 5")
+	flag.IntVar(&replicas, "R", 1, "Shorthand for -replicas")
+	var resume = flag.Bool("resume", false, "Resume an interrupted get from where it left off instead of starting over")
+	var rm = flag.Bool("rm", false, "Delete the stream once get has retrieved and verified the file")
+	var noVerify = flag.Bool("no-verify", false, "Skip checking the digest on get, the same as -verify gap")
+	var fileName = flag.String("name", "", "Stream name to put a file in or get from, instead of one derived from the file name. For put from stdin, or on recover, the file name to record")
+	var chunk = flag.String("chunk", "64k", "Chunk size to put with, e.g. 64k or 1m, or that the stream was written with for recover")
+	var maxGapRetries = flag.Int("max-gap-retries", 10, "Maximum number of times get will recover from missed chunks (0 is no limit)")
+	var tee = flag.Bool("tee", false, "Also write the file to stdout on get")
+	var pipe = flag.String("pipe", "", "Write the file to the stdin of this shell command on get, instead of to a file")
+	var placementCluster = flag.String("placement-cluster", "", "Cluster to place the stream in on put")
+	var placementTags = flag.String("placement-tags", "", "Server tags to place the stream by on put (separated by comma)")
+	var checkpoint = flag.String("checkpoint", "", "File to save verify progress in, so an interrupted verify can resume")
+	var chunkSizeAuto = flag.Bool("chunk-size-auto", false, "Pick the chunk size on put from the server's maximum payload")
+	var compression = flag.String("compress", xfer.CompressionNone, "Compression for the chunks on put, none or gzip")
+	var compressExt = flag.String("compress-ext", "", "Compress files with these extensions on put, e.g. .txt,.log,.json")
+	var adaptiveFlow = flag.Bool("adaptive-flow", false, "Adapt the number of outstanding chunks on put to how fast the server keeps up")
+	var dedup = flag.Bool("dedup", false, "Store files with the same contents only once when putting many files or a directory")
+	var chunkTiming = flag.String("chunk-timing", "", "Report chunk inter-arrival times on get, as text or json (on stdout)")
+	var completionGrace = flag.Duration("completion-grace", 0, "Time for get to wait for more chunks once it appears done, for streams still being written without a trailer")
+	var allowExisting = flag.Bool("allow-existing-stream", false, "Put into the stream if it already exists and is empty, e.g. when created by an operator")
+	var cas = flag.Bool("cas", false, "Name the stream by the SHA-256 digest of the file on put and print it, for content addressed storage")
+	var deep = flag.Bool("deep", false, "Compare the stored contents byte for byte instead of by size and digest")
+	var noRecover = flag.Bool("no-recover", false, "Fail get on a missed chunk instead of recovering it, e.g. for testing")
+	var tarFlag = flag.Bool("tar", false, "Put a directory as a single tar archive, or on get write out such an archive instead of extracting it")
+	var followSymlinks = flag.Bool("follow-symlinks", false, "Include the targets of symbolic links when putting a directory, instead of skipping them")
+	var prefix = flag.String("prefix", "", "Namespace for the streams and subjects of transfers, e.g. a team name, to keep them apart on a shared server")
+	var domain = flag.String("domain", "", "JetStream domain to use, e.g. for leafnode deployments")
+	var apiTimeout = flag.Duration("api-timeout", 5*time.Second, "Timeout for JetStream API requests")
+	var maxReconnects = flag.Int("max-reconnects", 10, "Times to try reconnecting after losing the connection before giving up (-1 is forever)")
+	var reconnectWait = flag.Duration("reconnect-wait", time.Second, "Time to wait between reconnect attempts")
+	var timeout = flag.Duration("timeout", 0, "Maximum time for a put or get, after which it fails and cleans up as if interrupted (0 is no limit)")
+	var recvTimeout = flag.Duration("recv-timeout", 0, "Time for get to wait for each chunk before deciding no more are coming (0 is 5s for the first and 1s for the rest)")
+	var retries = flag.Int("retries", 3, "Times put resends a chunk that failed with a transient error, such as a timeout, before giving up")
+	var ttl = flag.Duration("ttl", 0, "Maximum age of the chunks in the streams put creates, after which they expire (0 is no expiry)")
+	var storage = flag.String("storage", "file", "Storage for the streams put creates, file or memory, which is faster but lost if the server restarts")
+	var rateFlag = flag.String("rate", "0", "Maximum rate for put and get in bytes per second, e.g. 10m for 10MB/s (0 is no limit)")
+	var encrypt = flag.Bool("encrypt", false, "Encrypt the chunks on put with a key derived from the passphrase")
+	var passphrase = flag.String("passphrase", "", "Passphrase for encrypted transfers, "+passphraseEnv+" is used if not given")
+	var failFast = flag.Bool("fail-fast", false, "Stop at the first file that fails when putting or getting several, instead of carrying on with the rest")
+	var output string
+	flag.StringVar(&output, "output", "", "File or directory to write to on get, instead of the original file name in the current directory")
+	flag.StringVar(&output, "o", "", "Shorthand for -output")
+	var force bool
+	flag.BoolVar(&force, "force", false, "Replace the destination file on get if it already exists, or on put skip checking the account has storage left and with -overwrite replace a stream that does not hold a transfer")
+	flag.BoolVar(&force, "f", false, "Shorthand for -force")
+	var keepPartial = flag.Bool("keep-partial", false, "Keep the partial stream or file of an interrupted put or get instead of removing it")
+	var overwrite = flag.Bool("overwrite", false, "Delete and recreate the stream on put if it already exists, as long as it holds a transfer unless -force is given")
+	var appendFlag = flag.Bool("append", false, "Continue an interrupted put of the same file, publishing after the chunks its stream already holds")
+	var parallel = flag.Int("parallel", 0, "Experimental: split a file into this many regions on put and publish them at once, each on its own subject")
+	var rmAll = flag.Bool("all", false, "Remove every transfer with rm")
+	var yes = flag.Bool("y", false, "Do not ask for confirmation before rm deletes streams")
+	var dryRun = flag.Bool("dry-run", false, "Report what put or get would do, without creating, publishing or writing anything")
+	flag.BoolVar(&jsonOutput, "json", false, "Report each completed put or get, ping, or the -dump-config settings, as a JSON object on stdout instead of a log line, without progress updates")
+	var verbose = flag.Bool("v", false, "Log more detail, such as the stream and consumer configuration, every chunk and every retry")
+	var quiet = flag.Bool("q", false, "Only log errors")
+	var dumpConfig = flag.Bool("dump-config", false, "Print the effective settings and exit")
 	var showHelp = flag.Bool("h", false, "Show help message")
 
 	log.SetFlags(0)
+	log.SetOutput(status)
 	flag.Usage = usage
 	flag.Parse()
 
 	if *showHelp {
 		showUsageAndExit(0)
 	}
+	if *verbose && *quiet {
+		log.Fatalf("Can not use -v with -q")
+	} else if *verbose {
+		logLevel = levelVerbose
+	} else if *quiet {
+		logLevel = levelQuiet
+	}
+	if err := applyEnv(); err != nil {
+		log.Fatalf("Error reading environment: %v", err)
+	}
+	if *natsCtx != "" {
+		if err := applyContext(*natsCtx); err != nil {
+			log.Fatalf("Error loading context %q: %v", *natsCtx, err)
+		}
+	}
+	if *dumpConfig {
+		if err := dumpSettings(os.Stdout, flag.CommandLine); err != nil {
+			log.Fatalf("Error printing settings: %v", err)
+		}
+		os.Exit(0)
+	}
 
 	args := flag.Args()
-	if len(args) < 2 {
+	if len(args) < 1 {
 		showUsageAndExit(1)
 	}
 
 	cmd := strings.ToLower(args[0])
-	if cmd != "put" && cmd != "get" {
+	switch cmd {
+	case "put":
+		if len(args) < 2 && *fromList == "" {
+			showUsageAndExit(1)
+		}
+	case "get":
+		// With -name the stream is given directly.
+		if (len(args) < 2) == (*fileName == "") {
+			showUsageAndExit(1)
+		}
+	case "alias", "recover", "verify", "ensure", "list-chunks":
+		if len(args) < 2 {
+			showUsageAndExit(1)
+		}
+	case "compare", "copy":
+		if len(args) < 3 {
+			showUsageAndExit(1)
+		}
+	case "rm":
+		if len(args) < 2 && !*rmAll && *fileName == "" {
+			showUsageAndExit(1)
+		}
+	case "list", "ping":
+	default:
 		showUsageAndExit(1)
 	}
 
+	if *fsync != fsyncAlways && *fsync != fsyncFinal && *fsync != fsyncNever {
+		log.Fatalf("Invalid fsync policy %q", *fsync)
+	}
+	if *sortBy != "name" && *sortBy != "size" && *sortBy != "date" {
+		log.Fatalf("Invalid sort order %q", *sortBy)
+	}
+	if *verify != xfer.VerifyGap && *verify != xfer.VerifyFull && *verify != xfer.VerifyNone {
+		log.Fatalf("Invalid verify level %q", *verify)
+	}
+	if *offset < 0 || *length < 0 {
+		log.Fatalf("Invalid range, -offset and -length can not be negative")
+	}
+	if (*offset > 0 || *length > 0) && (*sinceSeq > 0 || *untilSeq > 0) {
+		log.Fatalf("Can not use -offset or -length with -since-seq or -until-seq")
+	}
+	// Only delete a stream once we know we have all of it.
+	if *rm && (*sinceSeq > 0 || *untilSeq > 0 || *offset > 0 || *length > 0 || *verify == xfer.VerifyNone) {
+		log.Fatalf("Can not use -rm when retrieving a window or range or with -verify none")
+	}
+	if replicas < 1 || replicas > 5 {
+		log.Fatalf("Invalid number of replicas %d, must be between 1 and 5", replicas)
+	}
+	if *noVerify {
+		if flagSet("verify") {
+			log.Fatalf("Use either -verify or -no-verify, not both")
+		}
+		*verify = xfer.VerifyGap
+	}
+	if *chunkTiming != "" && *chunkTiming != timingText && *chunkTiming != timingJSON {
+		log.Fatalf("Invalid chunk timing format %q", *chunkTiming)
+	}
+	if *chunkTiming == timingJSON && *tee {
+		log.Fatalf("JSON chunk timing and -tee both write to stdout")
+	}
+	if *pipe != "" {
+		// The command gets the file as a stream, so we can neither seek in
+		// it nor pick up where an interrupted get left off.
+		if *tee || *resume || *sinceSeq > 0 || *untilSeq > 0 {
+			log.Fatalf("Can not use -pipe with -tee, -resume, -since-seq or -until-seq")
+		}
+		if output != "" {
+			log.Fatalf("Can not use -pipe with -o, the command decides where the file goes")
+		}
+	}
+	if jsonOutput && (*tee || *chunkTiming == timingJSON) {
+		log.Fatalf("Can not use -json with -tee or JSON chunk timing, which also write to stdout")
+	}
+	if *compression != xfer.CompressionNone && *compression != xfer.CompressionGzip {
+		log.Fatalf("Invalid compression %q", *compression)
+	}
+	if *replay != "instant" && *replay != "original" {
+		log.Fatalf("Invalid replay policy %q", *replay)
+	}
+	if *mode != xfer.ConsumerFlow && *mode != xfer.ConsumerPull {
+		log.Fatalf("Invalid consumer mode %q", *mode)
+	}
+	if *maxAckPending <= 0 {
+		log.Fatalf("Invalid maximum of pending acks %d", *maxAckPending)
+	}
+	wbs, err := parseSize(*writeBuf)
+	if err != nil {
+		log.Fatalf("Invalid write buffer size: %v", err)
+	}
+	if *overwrite && (*appendFlag || *allowExisting) {
+		log.Fatalf("Use only one of -overwrite, -append and -allow-existing-stream")
+	}
+	if *appendFlag && (*allowExisting || *cas) {
+		log.Fatalf("Can not use -append with -allow-existing-stream or -cas")
+	}
+	if *retries < 0 {
+		log.Fatalf("Invalid number of retries %d", *retries)
+	}
+	if *maxReconnects < -1 {
+		log.Fatalf("Invalid number of reconnects %d", *maxReconnects)
+	}
+	if *reconnectWait <= 0 {
+		log.Fatalf("Invalid reconnect wait %v", *reconnectWait)
+	}
+	if *parallel < 0 {
+		log.Fatalf("Invalid number of regions %d", *parallel)
+	}
+	if *parallel > 1 && (*follow || *appendFlag || *allowExisting) {
+		log.Fatalf("Can not use -parallel with -follow, -append or -allow-existing-stream")
+	}
+	if *ttl < 0 {
+		log.Fatalf("Invalid ttl %v", *ttl)
+	}
+	if *storage != "file" && *storage != "memory" {
+		log.Fatalf("Invalid storage %q", *storage)
+	}
+	rate, err := parseSize(*rateFlag)
+	if err != nil {
+		log.Fatalf("Invalid rate: %v", err)
+	}
+	var compressExts []string
+	if *compressExt != "" {
+		if compressExts, err = parseExtList(*compressExt); err != nil {
+			log.Fatalf("Invalid -compress-ext: %v", err)
+		}
+	}
+	chunkSize, err := parseSize(*chunk)
+	if err != nil || chunkSize <= 0 {
+		log.Fatalf("Invalid chunk size %q", *chunk)
+	}
+	if *chunkSizeAuto && flagSet("chunk") {
+		log.Fatalf("Use either -chunk or -chunk-size-auto, not both")
+	}
+
+	if *fileName != "" && (cmd == "get" || cmd == "put" && !(len(args) > 1 && args[1] == "-")) {
+		if !validStreamName(*fileName) {
+			log.Fatalf("Invalid stream name %q", *fileName)
+		}
+		if cmd == "put" && (*fromList != "" || *cas || len(args) > 2) {
+			log.Fatalf("A stream name can only be used when putting a single file by name")
+		}
+	}
+
+	// Several files are retrieved at once, so they can not share stdout, and
+	// stdin can only be put on its own.
+	if cmd == "get" && len(args) > 2 {
+		if *fileName != "" {
+			log.Fatalf("A stream name can only be used when getting a single file")
+		}
+		if *tee || *pipe != "" || *chunkTiming != "" {
+			log.Fatalf("Can not use -tee, -pipe or -chunk-timing when getting several files")
+		}
+		if output != "" && !isDir(output) {
+			log.Fatalf("Output %q must be a directory when getting several files", output)
+		}
+	}
+	if cmd == "put" && len(args) > 2 {
+		for _, a := range args[1:] {
+			if a == "-" {
+				log.Fatalf("Stdin can only be put on its own")
+			}
+		}
+	}
+
+	jsDomain = *domain
+	jsAPITimeout = *apiTimeout
+	if *prefix != "" && !validPrefix(*prefix) {
+		log.Fatalf("Invalid prefix %q, use only letters, digits, dashes and underscores", *prefix)
+	}
+	streamPrefix = *prefix
+
+	if *passphrase == "" {
+		*passphrase = os.Getenv(passphraseEnv)
+	}
+	if *encrypt && *passphrase == "" {
+		log.Fatalf("Encrypting needs a passphrase, from -passphrase or %s", passphraseEnv)
+	}
+	decrypter = xfer.NewDecrypter(*passphrase)
+
 	// Connect Options.
 	opts := []nats.Option{nats.Name("NATS JetStream Transfer")}
-	opts = setupConnOptions(opts)
+	opts = setupConnOptions(opts, *maxReconnects, *reconnectWait)
+	tlsOpts, err := tlsOptions(*tlsCert, *tlsKey, *tlsCA, *tlsSkipVerify)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+	opts = append(opts, tlsOpts...)
+
+	// Only one way of authenticating can be used.
+	auth := 0
+	for _, a := range []string{*creds, *nkey, *token} {
+		if a != "" {
+			auth++
+		}
+	}
+	if auth > 1 {
+		log.Fatalf("Use only one of -creds, -nkey and -token")
+	}
 
 	// Use UserCredentials
 	if *creds != "" {
 		opts = append(opts, nats.UserCredentials(*creds))
 	}
 
+	// Use an NKey
+	if *nkey != "" {
+		opt, err := nats.NkeyOptionFromSeed(*nkey)
+		if err != nil {
+			log.Fatalf("Error loading nkey seed: %v", err)
+		}
+		opts = append(opts, opt)
+	}
+
+	// Use a Token
+	if *token != "" {
+		opts = append(opts, nats.Token(*token))
+	}
+
 	// Connect to NATS
 	nc, err := nats.Connect(*urls, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer nc.Close()
+
+	var placement *nats.Placement
+	if *placementCluster != "" || *placementTags != "" {
+		placement = &nats.Placement{Cluster: *placementCluster}
+		for _, tag := range strings.Split(*placementTags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				placement.Tags = append(placement.Tags, tag)
+			}
+		}
+	}
+	popts := &putOptions{
+		alias:          *alias,
+		waitDurable:    *waitDurable,
+		follow:         *follow,
+		maxDuration:    *maxDuration,
+		subjFromHash:   *subjFromHash,
+		placement:      placement,
+		replicas:       replicas,
+		chunkSize:      chunkSize,
+		chunkSizeAuto:  *chunkSizeAuto,
+		compression:    *compression,
+		compressExts:   compressExts,
+		adaptiveFlow:   *adaptiveFlow,
+		name:           *fileName,
+		dedup:          *dedup,
+		allowExisting:  *allowExisting,
+		cas:            *cas,
+		followSymlinks: *followSymlinks,
+		keepPartial:    *keepPartial,
+		rate:           int64(rate),
+		ttl:            *ttl,
+		retries:        *retries,
+		dryRun:         *dryRun,
+		overwrite:      *overwrite,
+		force:          force,
+		append:         *appendFlag,
+		parallel:       *parallel,
+		tar:            *tarFlag,
+	}
+	if *storage == "memory" {
+		popts.storage = nats.MemoryStorage
+	}
+	if *encrypt {
+		popts.passphrase = *passphrase
+	}
+
+	// Transfers stop cleanly when interrupted or out of time, other commands
+	// just exit.
+	ctx := context.Background()
+	if cmd == "put" || cmd == "get" || cmd == "ensure" {
+		ctx = interruptContext()
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+	}
+	ctx = withConnClosed(ctx)
 
 	switch cmd {
 	case "put":
-		putFile(nc, args[1])
+		var files []string
+		if *fromList != "" {
+			if files, err = readFileList(*fromList, *nullSep); err != nil {
+				log.Fatalf("Error reading file list: %v", err)
+			}
+		} else {
+			files = args[1:]
+		}
+		if *alias != "" && len(files) > 1 {
+			log.Fatalf("An alias can only be used when putting a single file")
+		}
+		if err = checkStreamLimit(nc, files, popts, *limitStreams); err == nil {
+			err = putFiles(ctx, nc, files, popts, *failFast)
+		}
+	case "ensure":
+		err = ensureFile(ctx, nc, args[1], popts)
 	case "get":
-		getFile(nc, args[1])
+		files := args[1:]
+		if *fileName != "" {
+			files = []string{*fileName}
+		}
+		err = getFiles(ctx, nc, files, &getOptions{
+			strict:          *strictMeta,
+			fsync:           *fsync,
+			writeBuf:        wbs,
+			follow:          *follow,
+			replayOriginal:  *replay == "original",
+			mode:            *mode,
+			maxAckPending:   *maxAckPending,
+			sinceSeq:        *sinceSeq,
+			untilSeq:        *untilSeq,
+			offset:          *offset,
+			length:          *length,
+			verify:          *verify,
+			maxGapRetries:   *maxGapRetries,
+			tee:             *tee,
+			pipe:            *pipe,
+			chunkTiming:     *chunkTiming,
+			completionGrace: *completionGrace,
+			recvTimeout:     *recvTimeout,
+			noRecover:       *noRecover,
+			rm:              *rm,
+			stream:          withPrefix(*fileName),
+			resume:          *resume,
+			keepPartial:     *keepPartial,
+			passphrase:      *passphrase,
+			rate:            int64(rate),
+			labelProgress:   len(files) > 1,
+			output:          output,
+			force:           force,
+			dryRun:          *dryRun,
+			tar:             *tarFlag,
+		}, *failFast)
+	case "list":
+		err = listTransfers(nc, *sortBy, *reverse, *limit)
+	case "ping":
+		err = pingServer(nc)
+	case "rm":
+		names := args[1:]
+		if *fileName != "" {
+			names = append(names, *fileName)
+		}
+		err = removeTransfers(nc, names, *rmAll, *yes, *dryRun)
+	case "alias":
+		err = aliasCommand(nc, args[1:])
+	case "recover":
+		err = recoverStream(nc, withPrefix(args[1]), *fileName, chunkSize)
+	case "verify":
+		err = verifyStream(nc, args[1], *checkpoint, *strictMeta)
+	case "list-chunks":
+		err = listChunks(nc, args[1])
+	case "compare":
+		err = compareFile(nc, args[1], args[2], *deep)
+	case "copy":
+		dst := nc
+		if *urls2 != "" {
+			if dst, err = nats.Connect(*urls2, opts...); err != nil {
+				exit(nc, fmt.Errorf("error connecting to %s: %v", *urls2, err))
+			}
+		}
+		err = copyTransfer(ctx, nc, dst, args[1], withPrefix(args[2]), *keepPartial)
+		if dst != nc {
+			dst.Close()
+		}
 	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", *timeout)
+	}
+	exit(nc, err)
+}
+
+// redactedFlags hold secrets that dumpSettings will not print.
+var redactedFlags = map[string]bool{
+	"creds":      true,
+	"token":      true,
+	"passphrase": true,
+}
+
+// dumpSettings prints the effective value of each flag in fs to w, as a
+// JSON object with -json.
+func dumpSettings(w io.Writer, fs *flag.FlagSet) error {
+	settings := make(map[string]string)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "dump-config" || f.Name == "h" {
+			return
+		}
+		v := f.Value.String()
+		if redactedFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		settings[f.Name] = v
+		names = append(names, f.Name)
+	})
+	if jsonOutput {
+		return json.NewEncoder(w).Encode(settings)
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%-16s %s\n", name, settings[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validStreamName reports whether name can be used as a stream name.
+func validStreamName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".*>/\\ \t\r\n")
 }
 
+// maxNamePrefix is how much of a file name canonicalName keeps readable.
+const maxNamePrefix = 64
+
+// canonicalName returns the stream name for a file. Names that are already
+// valid stream names, such as Makefile, are used as is. Otherwise anything
+// but letters, digits, dashes and underscores is replaced, and a short hash
+// of the original name is appended so that, say, foo.txt and foo_txt or
+// .bashrc and _bashrc do not collide. Only the file's base name is used, so
+// the same file name maps to the same stream on any machine.
 func canonicalName(name string) string {
+	fn := filepath.Base(filepath.Clean(name))
+	// The current or parent directory is named after what it refers to.
+	if fn == "." || fn == ".." {
+		if abs, err := filepath.Abs(name); err == nil {
+			fn = filepath.Base(abs)
+		}
+	}
+	prefix := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, fn)
+	if prefix == fn && len(fn) <= maxNamePrefix {
+		return withPrefix(fn)
+	}
+	if len(prefix) > maxNamePrefix {
+		prefix = prefix[:maxNamePrefix]
+	}
+	sum := sha256.Sum256([]byte(fn))
+	return withPrefix(prefix + "_" + hex.EncodeToString(sum[:4]))
+}
+
+// legacyName is the stream name earlier versions used for a file, with
+// dots and spaces replaced, so their transfers can still be found by name.
+func legacyName(name string) string {
 	fn := filepath.Base(filepath.Clean(name))
 	fn = strings.ReplaceAll(fn, ".", "_")
-	return strings.ReplaceAll(fn, " ", "_")
+	return withPrefix(strings.ReplaceAll(fn, " ", "_"))
+}
+
+// streamPrefix namespaces the streams and subjects of our transfers, set
+// with -prefix.
+var streamPrefix string
+
+func validPrefix(prefix string) bool {
+	return validStreamName(prefix) && validAlias(prefix)
+}
+
+// withPrefix returns the stream name in our namespace.
+func withPrefix(stream string) string {
+	if streamPrefix == "" || stream == "" {
+		return stream
+	}
+	return streamPrefix + "_" + stream
+}
+
+// prefixFilter selects the transfers in our namespace. Without a prefix
+// that is all of them.
+func prefixFilter() xfer.Filter {
+	if streamPrefix == "" {
+		return xfer.Filter{}
+	}
+	return xfer.Filter{Prefix: streamPrefix + "_"}
+}
+
+// withSubjectPrefix returns the subject in our namespace.
+func withSubjectPrefix(subj string) string {
+	if streamPrefix == "" {
+		return subj
+	}
+	return streamPrefix + "." + subj
+}
+
+// putStream returns the stream a put of fileName goes to, which for "-" is
+// named by the options, and with content addressing the digest of the
+// contents that names it instead.
+func putStream(fileName string, popts *putOptions) (string, string, error) {
+	if fileName == "-" {
+		if popts.cas {
+			return "", "", errors.New("content addressing needs a file, it can not read from stdin")
+		}
+		return canonicalName(popts.name), "", nil
+	}
+	if popts.cas {
+		digest, err := fileDigest(fileName)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %q: %v", fileName, err)
+		}
+		return withPrefix(casPrefix + digest), digest, nil
+	}
+	if popts.name != "" {
+		return withPrefix(popts.name), "", nil
+	}
+	return canonicalName(fileName), "", nil
+}
+
+// checkStreamLimit makes sure a put of the files will not exceed the account's
+// stream limit or our own limit, so we do not fail partway. Only the streams
+// the put creates count, not those it replaces, continues or finds already
+// holding the contents.
+func checkStreamLimit(nc *nats.Conn, files []string, popts *putOptions, limit int) error {
+	js := newJetStream(nc)
+	ai, err := js.AccountInfo()
+	if err != nil {
+		return fmt.Errorf("error retrieving account info: %v", err)
+	}
+	// A negative limit means unlimited.
+	max := ai.Limits.MaxStreams
+	if limit <= 0 && max < 0 {
+		return nil
+	}
+	// Content addressed files with the same contents share a stream.
+	created := make(map[string]bool)
+	for _, fileName := range files {
+		stream, _, err := putStream(fileName, popts)
+		if err != nil {
+			// The put of this file reports it.
+			continue
+		}
+		if _, err := xfer.LookupStream(js, stream); err == xfer.ErrStreamNotFound {
+			created[stream] = true
+		}
+	}
+	n := len(created)
+	if limit > 0 && n > limit {
+		return fmt.Errorf("transfer of %d files would create %d streams, more than %d. "+
+			"Consider putting their directory, which is a single stream, or using -tar", len(files), n, limit)
+	}
+	if max >= 0 && ai.Streams+n > max {
+		return fmt.Errorf("transfer of %d files would create %d streams, exceeding the account limit of %d streams, %d are in use. "+
+			"Consider putting their directory, which is a single stream, or using -tar", len(files), n, max, ai.Streams)
+	}
+	return nil
+}
+
+// checkStorage refuses to put size bytes when the account does not have
+// the storage left for them, along with the stored bytes we replace or
+// continue from, so a put does not fail partway and leave a partial stream.
+// Each replica counts against the limit.
+func checkStorage(js nats.JetStreamContext, fileName string, size, stored int64, popts *putOptions) error {
+	ai, err := js.AccountInfo()
+	if err != nil {
+		return fmt.Errorf("error retrieving account info: %v", err)
+	}
+	kind, max, used := "file", ai.Limits.MaxStore, int64(ai.Store)
+	if popts.storage == nats.MemoryStorage {
+		kind, max, used = "memory", ai.Limits.MaxMemory, int64(ai.Memory)
+	}
+	// A negative limit means unlimited.
+	if max < 0 {
+		return nil
+	}
+	replicas := int64(popts.replicas)
+	if replicas < 1 {
+		replicas = 1
+	}
+	needed, left := (size-stored)*replicas, max-used
+	if needed <= left {
+		return nil
+	}
+	if left < 0 {
+		left = 0
+	}
+	return fmt.Errorf("%q needs %v of %s storage, but the account only has %v of its %v left. "+
+		"Free up space, or use -force if the limit will be raised in time",
+		fileName, friendlyBytes(int(needed)), kind, friendlyBytes(int(left)), friendlyBytes(int(max)))
+}
+
+// hashedSubject returns a subject derived from a hash of the stream's name,
+// which, unlike the file's, is unique.
+func hashedSubject(stream string) string {
+	sum := sha256.Sum256([]byte(stream))
+	return "njs-xfer." + hex.EncodeToString(sum[:16])
+}
+
+// jsDomain is the JetStream domain we will use, if any.
+var jsDomain string
+
+// jsAPITimeout is how long we wait for JetStream API requests.
+var jsAPITimeout time.Duration
+
+// passphraseEnv is the environment variable the passphrase is read from
+// when -passphrase is not given.
+const passphraseEnv = "NJS_XFER_KEY"
+
+// decrypter reads the chunks of encrypted transfers for the commands that
+// inspect them, such as verify and compare.
+var decrypter = xfer.NewDecrypter("")
+
+// newJetStream creates our JetStream context, targeting our domain if one was given.
+// On an error we will just exit.
+func newJetStream(nc *nats.Conn, opts ...nats.JSOpt) nats.JetStreamContext {
+	js, err := jetStream(nc, opts...)
+	if err == nats.ErrJetStreamNotEnabled && jsDomain != "" {
+		log.Fatalf("JetStream not enabled for domain %q", jsDomain)
+	} else if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return js
+}
+
+// jetStream returns a JetStream context for our domain and API timeout.
+func jetStream(nc *nats.Conn, opts ...nats.JSOpt) (nats.JetStreamContext, error) {
+	if jsAPITimeout > 0 {
+		opts = append(opts, nats.MaxWait(jsAPITimeout))
+	}
+	if jsDomain != "" {
+		opts = append(opts, nats.APIPrefix(fmt.Sprintf("$JS.%s.API", jsDomain)))
+	}
+	return nc.JetStream(opts...)
+}
+
+// putOptions control how putFile stores a file.
+type putOptions struct {
+	// Alias to register for the transfer.
+	alias string
+	// Wait for all replicas to be current before reporting success.
+	waitDurable bool
+	// Keep publishing as the file grows until interrupted or maxDuration.
+	follow      bool
+	maxDuration time.Duration
+	// Use a deterministic subject derived from the file name.
+	subjFromHash bool
+	// Where the stream should be placed in a clustered JetStream, nil for anywhere.
+	placement *nats.Placement
+	// Number of replicas for the stream.
+	replicas int
+	// Size of the chunks, unless sized based on the server's maximum payload.
+	chunkSize     int
+	chunkSizeAuto bool
+	// Compression for all files, and for files with these extensions.
+	compression  string
+	compressExts []string
+	// Adapt the publish window to how fast the server acknowledges chunks.
+	adaptiveFlow bool
+	// Name of the transfer when reading from stdin.
+	name string
+	// Store files in a batch with the same contents only once.
+	dedup bool
+	// Use the stream if it already exists, as long as it is empty.
+	allowExisting bool
+	// Name the stream by the digest of the contents, see casPrefix.
+	cas bool
+	// Include the targets of symbolic links when putting a directory.
+	followSymlinks bool
+	// Keep what was stored when interrupted instead of removing it.
+	keepPartial bool
+	// Passphrase to encrypt the chunks with, empty for none.
+	passphrase string
+	// Maximum rate to send at in bytes per second, 0 for no limit.
+	rate int64
+	// Storage for the streams we create.
+	storage nats.StorageType
+	// Maximum age of the chunks in the streams we create, 0 for no expiry.
+	ttl time.Duration
+	// Times to resend a chunk that failed with a transient error.
+	retries int
+	// Report what would be put without creating or publishing anything.
+	dryRun bool
+	// Replace an existing stream, even one that is not a transfer with force.
+	overwrite, force bool
+	// Continue an interrupted put in its existing stream.
+	append bool
+	// Regions to split a file into and publish at once, see xfer.PutOptions.
+	parallel int
+	// Put directories as tar archives, see xfer.PutTar.
+	tar bool
+}
+
+// casPrefix starts the names of content addressed streams, followed by the
+// hex encoded SHA-256 digest of the contents.
+const casPrefix = "sha256-"
+
+// Limit for automatically sized chunks. Even with a large maximum payload
+// there is little to gain from chunks bigger than this.
+const maxAutoChunkSize = 1024 * 1024
+
+// autoChunkSize picks a chunk size that fits within the maximum payload,
+// even when compressed or encrypted.
+func autoChunkSize(maxPayload int64, compress, encrypt bool) int {
+	size := maxPayload - xfer.ChunkHeaderRoom
+	if size > maxAutoChunkSize {
+		size = maxAutoChunkSize
+	}
+	// Keep to whole kilobytes.
+	size -= size % 1024
+	for size > 1024 && xfer.CheckChunkSize(int(size), maxPayload, compress, encrypt) != nil {
+		size -= 1024
+	}
+	if size < 1024 {
+		size = 1024
+	}
+	return int(size)
 }
 
 // putFile will place the file resource into a JetStream stream for later retrieval.
-func putFile(nc *nats.Conn, fileName string) {
+// A file name of "-" reads from stdin, using the name from the options.
+// It returns the result of the transfer, whose stream holds the contents.
+func putFile(ctx context.Context, nc *nats.Conn, fileName string, popts *putOptions) (*xfer.Result, error) {
 	// Make sure we have a legitimate file resource.
-	fd, err := os.Open(fileName)
+	var fd *os.File
+	var err error
+	if fileName == "-" {
+		if popts.name == "" {
+			return nil, errors.New("a name is needed when reading from stdin")
+		}
+		fd, fileName = os.Stdin, popts.name
+	} else {
+		if fd, err = os.Open(fileName); err != nil {
+			return nil, fmt.Errorf("error opening %q: %v", fileName, err)
+		}
+		defer fd.Close()
+	}
+	fi, err := fd.Stat()
 	if err != nil {
-		log.Fatalf("Error opening %q: %v", fileName, err)
+		return nil, fmt.Errorf("error reading %q: %v", fileName, err)
+	}
+	// Directories are sent whole, see xfer.PutDir.
+	isDir := fi.IsDir()
+	if isDir && (popts.follow || popts.cas || popts.append || popts.parallel > 1) {
+		return nil, fmt.Errorf("%q is a directory, which can not be followed, content addressed, appended to or put in parallel", fileName)
+	}
+	if popts.tar && !isDir {
+		return nil, fmt.Errorf("%q is not a directory, only directories are put as tar archives", fileName)
+	}
+	if fd == os.Stdin && popts.parallel > 1 {
+		return nil, errors.New("a parallel put needs a file, it can not read from stdin")
 	}
-	defer fd.Close()
 
-	// We could grab metadata for the file resource here and either use the first message
-	// to represent the metadata or as headers.
+	js := newJetStream(nc)
+
+	// Our metadata is carried in message headers.
+	if !nc.HeadersSupported() {
+		return nil, errors.New("server does not support headers, which are needed for transfer metadata")
+	}
 
-	// Create our jetstream context.
-	// On an error we will just exit.
-	errHandler := func(_ nats.JetStream, _ *nats.Msg, err error) {
-		log.Fatalf("Error sending chunk to JetStream: %v", err)
+	// With content addressing, if the stream exists we already have the file.
+	src := fileName
+	if fd == os.Stdin {
+		src = "-"
 	}
-	// We will use a sliding window and async publishes to maximize performance.
-	const maxPending = 8 // 8 * 64k
-	js, err := nc.JetStream(
-		nats.PublishAsyncMaxPending(maxPending),
-		nats.PublishAsyncErrHandler(errHandler),
-	)
+	stream, digest, err := putStream(src, popts)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
+	}
+	if popts.cas {
+		if si, err := js.StreamInfo(stream); err == nil {
+			tm, err := xfer.LookupMeta(js, si)
+			if err != nil || tm == nil || tm.Digest != digest {
+				return nil, fmt.Errorf("stream %q %w but is incomplete", stream, xfer.ErrExists)
+			}
+			infof("%q already present", fileName)
+			res := &xfer.Result{Stream: stream, Meta: tm}
+			if jsonOutput {
+				printReport("put", stream, fileName, res, 0)
+			} else {
+				fmt.Println(stream)
+			}
+			return res, nil
+		}
+	}
+	chunkSize := popts.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = xfer.DefaultChunkSize
+	}
+	// Each chunk has to fit in a message along with its headers, which we
+	// check before creating the stream so a failure leaves nothing behind.
+	compress := popts.compression == xfer.CompressionGzip || len(popts.compressExts) > 0
+	if popts.chunkSizeAuto {
+		chunkSize = autoChunkSize(nc.MaxPayload(), compress, popts.passphrase != "")
+		infof("Using a chunk size of %v for a maximum payload of %v",
+			friendlyBytes(chunkSize), friendlyBytes(int(nc.MaxPayload())))
+	}
+	if err := xfer.CheckChunkSize(chunkSize, nc.MaxPayload(), compress, popts.passphrase != ""); err != nil {
+		return nil, err
 	}
 
-	// We will use the filename as the stream name, but we need to replace "."
-	stream := canonicalName(fileName)
-	if _, err = js.StreamInfo(stream); err == nil {
-		log.Fatalf("Stream %q already exists", stream)
+	si, err := js.StreamInfo(stream)
+	existed := err == nil
+	// Likewise the account has to have room for the file, unless we are told
+	// otherwise. What a stream we replace or continue holds is freed or
+	// already stored.
+	if !popts.force && (fi.Mode().IsRegular() || isDir) {
+		size := fi.Size()
+		if isDir {
+			if size, _, _, err = treeSize(fileName, popts.followSymlinks, chunkSize); err != nil {
+				return nil, fmt.Errorf("error reading %q: %v", fileName, err)
+			}
+		}
+		var stored int64
+		if existed && (popts.overwrite || popts.append) {
+			stored = int64(si.State.Bytes)
+		}
+		if err := checkStorage(js, fileName, size, stored, popts); err != nil {
+			return nil, err
+		}
+	}
+	if existed && popts.overwrite {
+		if err := overwriteStream(js, si, popts); err != nil {
+			return nil, err
+		}
+		existed = false
+	}
+	if existed && !popts.allowExisting && !popts.append {
+		return nil, fmt.Errorf("stream %q %w, use -overwrite to replace it or -append to continue an interrupted put", stream, xfer.ErrExists)
+	}
+	// Check our alias up front so we do not fail after the transfer.
+	if popts.alias != "" {
+		if err := checkAlias(js, popts.alias, stream); err != nil {
+			return nil, err
+		}
 	}
-	// Delivery subject as an inbox to avoid accidentally interfering with other subjects.
-	subj := nats.NewInbox()
 
-	// Create our stream.
-	// TODO(dlc) - Could add in replication as an argument.
-	_, err = js.AddStream(&nats.StreamConfig{
-		Name:     stream,
-		Subjects: []string{subj},
-	})
+	if popts.dryRun {
+		n, err := dryRunPut(fileName, fi, stream, chunkSize, popts)
+		if err != nil {
+			return nil, err
+		}
+		return &xfer.Result{Stream: stream, Bytes: int64(n)}, nil
+	}
+	pr := startProgress("Sent", 0, 0)
+	defer pr.stop()
+	xopts := xfer.PutOptions{
+		Stream:         stream,
+		Name:           filepath.Base(fileName),
+		ChunkSize:      chunkSize,
+		MaxPayload:     nc.MaxPayload(),
+		Compress:       popts.compression == xfer.CompressionGzip,
+		CompressExts:   popts.compressExts,
+		AdaptiveFlow:   popts.adaptiveFlow,
+		Placement:      popts.placement,
+		Replicas:       popts.replicas,
+		AllowExisting:  popts.allowExisting,
+		Append:         popts.append,
+		WaitDurable:    popts.waitDurable,
+		FollowSymlinks: popts.followSymlinks,
+		Dedup:          popts.dedup,
+		Passphrase:     popts.passphrase,
+		Rate:           popts.rate,
+		Storage:        popts.storage,
+		MaxAge:         popts.ttl,
+		Retries:        popts.retries,
+		Parallel:       popts.parallel,
+		Progress:       pr.update,
+		Logf:           noticef,
+		Statusf:        statusf,
+		Debugf:         debugf,
+	}
+	if isDir && popts.tar {
+		xopts.Name += ".tar"
+	}
+	// Optionally we can use a deterministic subject that can be permissioned,
+	// while still avoiding the collisions the stream name may have.
+	if popts.subjFromHash {
+		xopts.Subject = withSubjectPrefix(hashedSubject(stream))
+	} else if streamPrefix != "" {
+		xopts.Subject = withSubjectPrefix(strings.Replace(nats.NewInbox(), nats.InboxPrefix, "inbox.", 1))
+	}
+
+	// When following we keep reading past the end of the file until we are
+	// interrupted or hit our maximum duration, and then write our trailer.
+	// Being interrupted is how a follow normally ends, so it does not cancel
+	// the put itself, although running out of time does.
+	pctx := ctx
+	if popts.follow {
+		stop := make(chan struct{})
+		go func() {
+			var timeout <-chan time.Time
+			if popts.maxDuration > 0 {
+				timeout = time.After(popts.maxDuration)
+			}
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return
+				}
+			case <-timeout:
+			}
+			close(stop)
+		}()
+		xopts.Follow = stop
+		pctx = withConnClosed(context.Background())
+		if d, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			pctx, cancel = context.WithDeadline(pctx, d)
+			defer cancel()
+		}
+	}
+
+	start := time.Now()
+	var res *xfer.Result
+	if isDir && popts.tar {
+		res, err = xfer.PutTar(pctx, js, fileName, xopts)
+	} else if isDir {
+		res, err = xfer.PutDir(pctx, js, fileName, xopts)
+	} else {
+		res, err = xfer.Put(pctx, js, fd, xopts)
+	}
+	// An append is meant to be continued, so it always keeps what it sent,
+	// as does a put that lost its connection, since it can not delete it.
+	if err != nil && pctx.Err() != nil && (popts.append || connLost(pctx)) {
+		pr.stop()
+		if isDir {
+			infof("Kept partial stream %q", stream)
+		} else {
+			infof("Kept partial stream %q, use -append to continue", stream)
+		}
+	} else if err != nil && pctx.Err() != nil && !popts.keepPartial {
+		pr.stop()
+		discardStream(js, stream, existed)
+	}
 	if err != nil {
-		log.Fatalf("Unexpected error creating stream: %v", err)
+		return nil, err
+	}
+	if popts.alias != "" {
+		if err := setAlias(js, popts.alias, stream); err != nil {
+			return res, fmt.Errorf("error setting alias: %v", err)
+		}
+	}
+	pr.stop()
+	if jsonOutput {
+		printReport("put", stream, fileName, res, time.Since(start))
+	} else {
+		infof("Completed transfer of %v in %v", friendlyBytes(int(res.Bytes)), time.Since(start))
+		if popts.adaptiveFlow {
+			infof("Settled on a publish window of %d chunks", res.Window)
+		}
+	}
+	if popts.cas && !jsonOutput {
+		fmt.Println(stream)
+	}
+	return res, nil
+}
+
+// dryRunPut reports what putting the file into stream would do, returning
+// its size. The number of chunks is an estimate, since compression may
+// shrink them and the size of a source like stdin is not known up front.
+func dryRunPut(fileName string, fi os.FileInfo, stream string, chunkSize int, popts *putOptions) (int, error) {
+	var size int64
+	var chunks int64
+	switch {
+	case fi.IsDir():
+		var files int
+		var err error
+		if size, chunks, files, err = treeSize(fileName, popts.followSymlinks, chunkSize); err != nil {
+			return 0, fmt.Errorf("error reading %q: %v", fileName, err)
+		}
+		log.Printf("Would put directory %q with %d files, %v, into stream %q in about %d chunks of %v",
+			fileName, files, friendlyBytes(int(size)), stream, chunks, friendlyBytes(chunkSize))
+	case !fi.Mode().IsRegular() || popts.follow:
+		log.Printf("Would put %q, whose size is not known up front, into stream %q in chunks of %v",
+			fileName, stream, friendlyBytes(chunkSize))
+	default:
+		size = fi.Size()
+		chunks = (size + int64(chunkSize) - 1) / int64(chunkSize)
+		log.Printf("Would put %q, %v, into stream %q in about %d chunks of %v",
+			fileName, friendlyBytes(int(size)), stream, chunks, friendlyBytes(chunkSize))
 	}
+	return int(size), nil
+}
 
-	// Define our chunk size to be 64k. Important not to make this too big, NATS likes smaller messages
-	// and is plenty fast to transfer at very high rates even with smaller payloads.
-	const chunkSize = 64 * 1024
-	chunk := make([]byte, chunkSize)
+// treeSize adds up the files below root a directory put would send, and
+// the chunks they would take.
+func treeSize(root string, followSymlinks bool, chunkSize int) (size, chunks int64, files int, err error) {
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() || (followSymlinks && fi.Mode()&os.ModeSymlink != 0) {
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+					return nil
+				}
+			}
+			size += fi.Size()
+			chunks += (fi.Size() + int64(chunkSize) - 1) / int64(chunkSize)
+			files++
+		}
+		return nil
+	})
+	return size, chunks, files, err
+}
+
+// overwriteStream deletes an existing stream so put can recreate it. Unless
+// forced, we only delete streams that hold transfers.
+func overwriteStream(js nats.JetStreamContext, si *nats.StreamInfo, popts *putOptions) error {
+	stream := si.Config.Name
+	if !popts.force {
+		ours, err := xfer.IsTransfer(js, si)
+		if err != nil {
+			return fmt.Errorf("error checking stream %q: %v", stream, err)
+		}
+		if !ours {
+			return fmt.Errorf("stream %q %w and does not hold a transfer, use -force to overwrite it anyway", stream, xfer.ErrExists)
+		}
+	}
+	if popts.dryRun {
+		log.Printf("Would delete stream %q", stream)
+		return nil
+	}
+	if err := js.DeleteStream(stream); err != nil {
+		return fmt.Errorf("error deleting stream %q: %v", stream, err)
+	}
+	infof("Deleted stream %q to overwrite it", stream)
+	return nil
+}
 
-	// TODO(dlc) - Coould compress here if we wanted as well.
+// discardStream removes what an interrupted put stored, deleting the stream
+// if we created it, or purging it if it was created for us.
+func discardStream(js nats.JetStreamContext, stream string, existed bool) {
+	// We may have been interrupted before it was created.
+	if _, err := xfer.LookupStream(js, stream); err == xfer.ErrStreamNotFound {
+		return
+	}
+	var err error
+	if existed {
+		err = js.PurgeStream(stream)
+	} else {
+		err = js.DeleteStream(stream)
+	}
+	if err != nil {
+		log.Printf("Error removing partial stream %q: %v", stream, err)
+		return
+	}
+	infof("Removed partial stream %q, use -keep-partial to keep it", stream)
+}
 
-	// Loop and grab chunks from the file.
-	start, bytes := time.Now(), 0
-	for {
-		n, err := fd.Read(chunk)
-		if err == io.EOF {
-			break
+// putFiles puts each of the files, continuing past any failures unless
+// failFast is set. When there is more than one file we report a summary at
+// the end.
+func putFiles(ctx context.Context, nc *nats.Conn, files []string, popts *putOptions, failFast bool) error {
+	if len(files) == 1 {
+		if _, err := putFile(ctx, nc, files[0], popts); err != nil {
+			return fmt.Errorf("put of %q failed: %w", files[0], err)
+		}
+		return nil
+	}
+	results := make([]fileResult, len(files))
+	for i, fileName := range files {
+		results[i].name = fileName
+	}
+	verb := "Transferred"
+	if popts.dryRun {
+		verb = "Checked"
+	}
+	defer func() { reportResults(verb, results) }()
+	// With dedup, files with the same contents as one already put are stored
+	// as references to its stream. Directories are stored whole, and
+	// deduplicate their own files, see xfer.PutDir.
+	seen := make(map[string]string)
+	for i, fileName := range files {
+		// Once interrupted there is no point trying the rest.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var n int
+		var err error
+		var digest string
+		if fi, serr := os.Stat(fileName); popts.dedup && (serr != nil || !fi.IsDir()) {
+			digest, err = fileDigest(fileName)
+		}
+		if stream, ok := seen[digest]; err == nil && ok {
+			err = putRef(nc, fileName, stream)
+		} else if err == nil {
+			var res *xfer.Result
+			if res, err = putFile(ctx, nc, fileName, popts); err == nil {
+				n = int(res.Bytes)
+				// The contents may be stored under another name, e.g. with -cas.
+				if digest != "" && !popts.dryRun {
+					seen[digest] = res.Stream
+				}
+			}
+		}
+		results[i] = fileResult{fileName, n, err, true}
+		if err != nil && ctx.Err() != nil {
+			return err
+		} else if err != nil && failFast {
+			return fmt.Errorf("put of %q failed: %w", fileName, err)
 		} else if err != nil {
-			log.Fatalf("Error reading: %v", err)
+			log.Printf("Put of %q failed: %v", fileName, err)
 		}
-		if _, err = js.PublishAsync(subj, chunk[:n]); err != nil {
-			log.Fatalf("Error sending chunk to JetStream: %v", err)
+	}
+	return resultsError(results)
+}
+
+// maxParallelGets is how many files getFiles retrieves at once.
+const maxParallelGets = 4
+
+// getFiles retrieves each of the files, a few at a time, continuing past any
+// failures unless failFast is set, in which case the rest are interrupted.
+// When there is more than one file we report a summary at the end.
+func getFiles(ctx context.Context, nc *nats.Conn, files []string, gopts *getOptions, failFast bool) error {
+	if len(files) == 1 {
+		_, err := getFile(ctx, nc, files[0], gopts)
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]fileResult, len(files))
+	for i, fileName := range files {
+		results[i].name = fileName
+	}
+	sem := make(chan struct{}, maxParallelGets)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for i := range results {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
 		}
-		bytes += n
+		wg.Add(1)
+		go func(r *fileResult) {
+			defer func() { <-sem; wg.Done() }()
+			r.bytes, r.err = getFile(ctx, nc, r.name, gopts)
+			r.done = true
+			if r.err == nil || ctx.Err() != nil {
+				return
+			}
+			if !failFast {
+				log.Printf("Get of %q failed: %v", r.name, r.err)
+				return
+			}
+			once.Do(func() {
+				first = fmt.Errorf("get of %q failed: %w", r.name, r.err)
+				cancel()
+			})
+		}(&results[i])
+	}
+	wg.Wait()
+	verb := "Retrieved"
+	if gopts.dryRun {
+		verb = "Checked"
+	}
+	reportResults(verb, results)
+	if first != nil {
+		return first
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	log.Printf("Completed transfer of %v in %v", friendlyBytes(bytes), time.Since(start))
+	return resultsError(results)
 }
 
-// getFile will retrieve the file resource from the JetStream stream.
-func getFile(nc *nats.Conn, fileName string) {
-	js, err := nc.JetStream()
+// fileResult is how the transfer of one of several files went, if it was
+// attempted at all.
+type fileResult struct {
+	name  string
+	bytes int
+	err   error
+	done  bool
+}
+
+// reportResults logs the outcome of each file and the total transferred.
+func reportResults(verb string, results []fileResult) {
+	if len(results) == 0 {
+		return
+	}
+	ok, total := 0, 0
+	for _, r := range results {
+		switch {
+		case !r.done:
+			infof("  %-40s skipped", r.name)
+			continue
+		case errors.Is(r.err, context.Canceled):
+			infof("  %-40s interrupted", r.name)
+			continue
+		case r.err != nil:
+			log.Printf("  %-40s failed: %v", r.name, r.err)
+			continue
+		}
+		infof("  %-40s %v", r.name, friendlyBytes(r.bytes))
+		ok++
+		total += r.bytes
+	}
+	infof("%s %d of %d files, %v total", verb, ok, len(results), friendlyBytes(total))
+}
+
+// resultsError returns an error if any of the files failed.
+func resultsError(results []fileResult) error {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(results))
+	}
+	return nil
+}
+
+// ensureFile puts the file unless a transfer with the same contents already
+// exists, under any name. Either way the file is then present on the server.
+func ensureFile(ctx context.Context, nc *nats.Conn, fileName string, popts *putOptions) error {
+	if fileName == "-" {
+		return fmt.Errorf("ensure needs a file to compare, it can not read from stdin")
+	}
+	if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+		return fmt.Errorf("ensure needs a file to compare, %q is a directory", fileName)
+	}
+	digest, err := fileDigest(fileName)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return fmt.Errorf("error reading %q: %v", fileName, err)
+	}
+	js := newJetStream(nc)
+	filter := prefixFilter()
+	filter.Meta = map[string]string{"sha256": digest}
+	tis, err := xfer.ListTransfers(js, filter)
+	if err != nil {
+		return fmt.Errorf("error listing transfers: %v", err)
+	}
+	if len(tis) > 0 {
+		infof("%q already present in stream %q", fileName, tis[0].Stream)
+		if popts.alias != "" {
+			if err := setAlias(js, popts.alias, tis[0].Stream); err != nil {
+				return fmt.Errorf("error setting alias: %v", err)
+			}
+		}
+		return nil
+	}
+	if _, err := putFile(ctx, nc, fileName, popts); err != nil {
+		return fmt.Errorf("put of %q failed: %w", fileName, err)
 	}
+	return nil
+}
 
-	stream := canonicalName(fileName)
-	si, err := js.StreamInfo(stream)
+// fileDigest returns the hex encoded SHA-256 digest of the file.
+func fileDigest(fileName string) (string, error) {
+	fd, err := os.Open(fileName)
 	if err != nil {
-		log.Fatalf("Could not find stream: %s", stream)
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	if _, err := os.Stat(stream); !os.IsNotExist(err) {
-		log.Fatalf("Destination file already exists: %s", stream)
+// readFileList reads the list of files to put from the named file, or stdin for "-".
+// Files are separated by newlines, or null characters if nullSep is set.
+// With newlines, blank lines and lines starting with "#" are skipped.
+func readFileList(name string, nullSep bool) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if nullSep {
+		sep = "\x00"
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), sep) {
+		if !nullSep {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+		}
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files listed")
 	}
+	return files, nil
+}
 
-	fd, err := os.Create(stream)
+// listTransfers will print the transfers stored in JetStream, sorted by name, size or date,
+// optionally reversed and limited to the first limit entries.
+func listTransfers(nc *nats.Conn, sortBy string, reverse bool, limit int) error {
+	js := newJetStream(nc)
+	tis, err := xfer.ListTransfers(js, prefixFilter())
 	if err != nil {
-		log.Fatalf("Error creating file: %v", err)
+		return fmt.Errorf("error listing transfers: %v", err)
+	}
+	// xfer.ListTransfers sorts by name, keep that order for ties.
+	switch sortBy {
+	case "size":
+		sort.SliceStable(tis, func(i, j int) bool { return tis[i].Size < tis[j].Size })
+	case "date":
+		sort.SliceStable(tis, func(i, j int) bool { return tis[i].Created.Before(tis[j].Created) })
+	}
+	if reverse {
+		for i, j := 0, len(tis)-1; i < j; i, j = i+1, j-1 {
+			tis[i], tis[j] = tis[j], tis[i]
+		}
+	}
+	if limit > 0 && len(tis) > limit {
+		tis = tis[:limit]
+	}
+	// Transfers in progress have no name or size yet.
+	var total int64
+	for _, ti := range tis {
+		name, size := ti.Name, friendlyBytes(int(ti.Size))
+		if ti.InProgress {
+			name, size = "-", "-"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%d\t%s\n", ti.Stream, name, size, ti.Created.Format(time.RFC3339),
+			ti.Msgs, friendlyBytes(int(ti.Bytes)))
+		total += ti.Size
+	}
+	fmt.Printf("Total: %s in %d transfers\n", friendlyBytes(int(total)), len(tis))
+	return nil
+}
+
+// Policies for when getFile will fsync the destination file.
+// Syncing each chunk is the most durable but slowest, syncing once at the
+// end guarantees the file is on disk before we report success, and never
+// syncing leaves it to the operating system.
+const (
+	fsyncAlways = "always"
+	fsyncFinal  = "final"
+	fsyncNever  = "never"
+)
+
+// getOptions control how getFile retrieves a file.
+type getOptions struct {
+	// Refuse streams that do not carry our metadata.
+	strict bool
+	// When to fsync the destination file.
+	fsync string
+	// Size of the write buffer for the destination file, 0 for none.
+	writeBuf int
+	// Wait for an in progress stream to be completed.
+	follow bool
+	// Deliver chunks at the rate they were originally published.
+	replayOriginal bool
+	// Kind of consumer to retrieve with, and the chunks a pull consumer may
+	// have unacknowledged.
+	mode          string
+	maxAckPending int
+	// Only retrieve the chunks in this window of stream sequences, 0 for unbounded.
+	sinceSeq, untilSeq uint64
+	// Only retrieve this range of bytes of the file, a length of 0 is to the end.
+	offset, length int64
+	// Level of integrity checking.
+	verify string
+	// Maximum number of times to recover from missed chunks, 0 for no limit.
+	maxGapRetries int
+	// Also write the file to stdout.
+	tee bool
+	// Shell command to write the file to instead of a file.
+	pipe string
+	// Report chunk inter-arrival times, as text or json, empty for none.
+	chunkTiming string
+	// How long to wait for more chunks once we appear to have them all.
+	completionGrace time.Duration
+	// How long to wait for each chunk, 0 for the default.
+	recvTimeout time.Duration
+	// Fail on missed chunks instead of recovering them.
+	noRecover bool
+	// Delete the stream after a successful retrieval.
+	rm bool
+	// Stream to retrieve from, instead of resolving the file name.
+	stream string
+	// Resume an interrupted retrieval.
+	resume bool
+	// Keep the partial file when interrupted instead of removing it.
+	keepPartial bool
+	// Passphrase to decrypt an encrypted transfer with.
+	passphrase string
+	// Maximum rate to receive at in bytes per second, 0 for no limit.
+	rate int64
+	// Name the file in progress reports, when retrieving several at once.
+	labelProgress bool
+	// File or directory to write to instead of the current directory.
+	output string
+	// Replace an existing destination file.
+	force bool
+	// Report what would be retrieved without writing or subscribing to anything.
+	dryRun bool
+	// Write out tar archives of directories instead of extracting them.
+	tar bool
+}
+
+// destPath returns where to write a file called name. With an output
+// directory it goes in there, and any other output path is used as is.
+func (gopts *getOptions) destPath(name string) string {
+	if gopts.output == "" {
+		return name
+	}
+	if isDir(gopts.output) || strings.HasSuffix(gopts.output, string(filepath.Separator)) {
+		return filepath.Join(gopts.output, name)
+	}
+	return gopts.output
+}
+
+// isDir reports whether path is an existing directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// progressVerb describes retrieving dest in progress reports.
+func (gopts *getOptions) progressVerb(dest string) string {
+	if gopts.labelProgress {
+		return dest + ": received"
+	}
+	return "Received"
+}
+
+// xferOptions returns the options to retrieve stream with, reporting
+// progress as it is written.
+func (gopts *getOptions) xferOptions(stream string, progress xfer.ProgressFunc) xfer.GetOptions {
+	return xfer.GetOptions{
+		Stream:          stream,
+		Verify:          gopts.verify,
+		MaxGapRetries:   gopts.maxGapRetries,
+		NoRecover:       gopts.noRecover,
+		Follow:          gopts.follow,
+		ReplayOriginal:  gopts.replayOriginal,
+		Mode:            gopts.mode,
+		MaxAckPending:   gopts.maxAckPending,
+		SinceSeq:        gopts.sinceSeq,
+		UntilSeq:        gopts.untilSeq,
+		Offset:          gopts.offset,
+		Length:          gopts.length,
+		CompletionGrace: gopts.completionGrace,
+		RecvTimeout:     gopts.recvTimeout,
+		Passphrase:      gopts.passphrase,
+		Rate:            gopts.rate,
+		Progress:        progress,
+		Logf:            noticef,
+		Statusf:         statusf,
+		Debugf:          debugf,
+	}
+}
+
+// checkStrictMeta returns an error unless stream has metadata with everything
+// a get or verify needs, instead of falling back to what a legacy stream implies.
+func checkStrictMeta(stream string, tm *xfer.Meta) error {
+	switch {
+	case tm == nil:
+		return fmt.Errorf("stream %q has no transfer metadata", stream)
+	case tm.Completion != xfer.CompletionTrailer:
+		return fmt.Errorf("stream %q has metadata from an older version without a completion trailer", stream)
+	case tm.Name == "":
+		return fmt.Errorf("stream %q has no file name in its metadata", stream)
+	case tm.Size < 0:
+		return fmt.Errorf("stream %q has no valid size in its metadata", stream)
+	case tm.ChunkSize <= 0:
+		return fmt.Errorf("stream %q has no valid chunk size in its metadata", stream)
+	}
+	if d, err := hex.DecodeString(tm.Digest); err != nil || len(d) != sha256.Size {
+		return fmt.Errorf("stream %q has no valid checksum in its metadata", stream)
+	}
+	return nil
+}
+
+// getFile will retrieve the file resource from the JetStream stream.
+// It returns the number of bytes retrieved.
+func getFile(ctx context.Context, nc *nats.Conn, fileName string, gopts *getOptions) (int, error) {
+	js := newJetStream(nc)
+
+	stream := gopts.stream
+	if stream == "" {
+		var err error
+		if stream, err = resolveStream(js, fileName); err != nil {
+			return 0, fmt.Errorf("error resolving %q: %v", fileName, err)
+		}
+	}
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return 0, fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return 0, fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil {
+		return 0, fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+	}
+	if gopts.strict {
+		if err := checkStrictMeta(stream, tm); err != nil {
+			return 0, err
+		}
+	}
+	// The file gets its original name and modification time when we know them,
+	// and otherwise the stream's name. This is what we were asked for, even
+	// when the contents are stored in another stream.
+	named, mtime := stream, time.Time{}
+	if tm != nil {
+		if name := tm.LocalName(); name != "" {
+			named = name
+		}
+		// An archive of a directory is extracted, unless we want the archive.
+		if tm.Tar && !gopts.tar {
+			named = strings.TrimSuffix(named, ".tar")
+		}
+		mtime = tm.ModTime
+	}
+	dest := gopts.destPath(named)
+	window := gopts.sinceSeq > 0 || gopts.untilSeq > 0 || gopts.offset > 0 || gopts.length > 0
+	if gopts.dryRun {
+		return dryRunGet(stream, tm, dest, gopts)
+	}
+	if tm != nil && (tm.Dir || tm.Tar && !gopts.tar) {
+		if (gopts.follow || gopts.tee || gopts.pipe != "" || window) && tm.Tar {
+			return 0, fmt.Errorf("stream %q holds a tar archive of a directory, which can not be extracted when following, teeing, piping or windowed, use -tar to retrieve the archive", stream)
+		} else if gopts.follow || gopts.tee || gopts.pipe != "" || window {
+			return 0, fmt.Errorf("stream %q holds a directory, which can not be followed, teed, piped or windowed", stream)
+		}
+		return getDir(ctx, js, stream, tm, dest, gopts)
+	}
+	// The regions of a parallel transfer are written at their offsets.
+	if tm != nil && len(tm.RegionDigests) > 0 && (gopts.follow || gopts.tee || gopts.pipe != "" || gopts.resume || window) {
+		return 0, fmt.Errorf("stream %q holds a parallel transfer, which can not be followed, teed, piped, resumed or windowed", stream)
+	}
+
+	// Unless we are fanning out or only retrieving part of the stream, we keep
+	// track of what we have written so an interrupted get can be resumed.
+	resumable := !window && !gopts.follow && !gopts.tee && gopts.pipe == "" && (tm == nil || len(tm.RegionDigests) == 0)
+	if gopts.resume && !resumable {
+		return 0, fmt.Errorf("can not resume when following, teeing, piping or retrieving a window")
+	}
+	if gopts.pipe != "" {
+		return pipeFile(ctx, js, stream, gopts)
+	}
+	stateFile := dest + resumeSuffix
+	var rs *resumeState
+	if gopts.resume {
+		if rs, err = loadResumeState(stateFile); err != nil {
+			return 0, fmt.Errorf("error resuming %q: %v", dest, err)
+		}
+	}
+
+	var fd *os.File
+	if rs != nil {
+		if fd, err = rs.reopen(dest); err != nil {
+			return 0, fmt.Errorf("error resuming %q: %v", dest, err)
+		}
+		infof("Resuming %q at sequence %d, %v already retrieved", dest, rs.Seq+1, friendlyBytes(int(rs.Size)))
+	} else {
+		if fi, err := os.Stat(dest); err == nil && gopts.force && fi.Mode().IsRegular() {
+			// We start over, so any state from an interrupted get is stale.
+			os.Remove(stateFile)
+		} else if !os.IsNotExist(err) {
+			if _, err := os.Stat(stateFile); err == nil && !gopts.resume {
+				return 0, fmt.Errorf("destination file %w: %s, use -resume to continue an interrupted get or -f to replace it", xfer.ErrExists, dest)
+			}
+			return 0, fmt.Errorf("destination file %w: %s, use -f to replace it", xfer.ErrExists, dest)
+		}
+		if fd, err = os.Create(dest); err != nil {
+			return 0, fmt.Errorf("error creating file: %v", err)
+		}
 	}
 	defer fd.Close()
 
-	// We have multiple options here with respect to configuring a consumer.
-	// We care about not being a slow consumer and recovering from any dataloss or missed chunks.
-	// We could do a replay controller rate, or max ack pending, or even a pull based consumer.
-	// However with this scenario, we really do not need acks or redeliveries and can use the new
-	// flowcontrol option to control bandwidth. We can use the consumer sequences to detect any missed
-	// chunks.
-
-	createSub := func(startSeq uint64) *nats.Subscription {
-		sub, err := js.SubscribeSync(
-			si.Config.Subjects[0],
-			nats.AckNone(),
-			nats.MaxDeliver(1),
-			nats.StartSequence(startSeq),
-			nats.EnableFlowControl(),
-		)
+	// Optionally buffer our writes to the file.
+	dw := &destWriter{fd: fd, w: fd, syncAlways: gopts.fsync == fsyncAlways}
+	if gopts.writeBuf > 0 {
+		dw.bw = bufio.NewWriterSize(fd, gopts.writeBuf)
+		dw.w = dw.bw
+	}
+	// Errors name their destination, since we may fan out to stdout as well.
+	dw.w = &namedWriter{dest, dw.w}
+	if gopts.tee {
+		// Report a closed pipe as an error instead of being killed by SIGPIPE.
+		signal.Ignore(syscall.SIGPIPE)
+		dw.w = io.MultiWriter(dw.w, &namedWriter{"stdout", os.Stdout})
+	}
+
+	var ct *chunkTimer
+	if gopts.chunkTiming != "" {
+		ct = &chunkTimer{}
+	}
+	var already int64
+	if rs != nil {
+		already = rs.Size
+	}
+	pr := startProgress(gopts.progressVerb(dest), already, 0)
+	defer pr.stop()
+
+	xopts := gopts.xferOptions(stream, pr.update)
+	if ct != nil {
+		xopts.OnChunk = ct.add
+	}
+	if rs != nil {
+		// What we already have needs to be hashed as well.
+		pf, err := os.Open(dest)
 		if err != nil {
-			log.Fatalf("Error creating consumer: %v", err)
+			return 0, fmt.Errorf("error reading %q to resume: %v", dest, err)
+		}
+		defer pf.Close()
+		xopts.Resume, xopts.Retrieved = &rs.Position, pf
+	}
+	if resumable {
+		// What we record must be on disk first.
+		xopts.Checkpoint = func(pos xfer.Position) {
+			if err := dw.flush(); err != nil {
+				log.Printf("Error saving resume state: %v", err)
+				return
+			}
+			rs := &resumeState{pos}
+			if err := rs.save(stateFile); err != nil {
+				log.Printf("Error saving resume state: %v", err)
+			}
 		}
-		return sub
 	}
 
-	sub := createSub(1)
-	defer sub.Unsubscribe()
+	start := time.Now()
+	res, err := xfer.Get(ctx, js, dw, xopts)
+	if err != nil && ctx.Err() != nil {
+		pr.stop()
+		discardFile(dw, dest, stateFile, gopts.keepPartial || connLost(ctx))
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Make sure everything has been written before we report success.
+	if gopts.fsync == fsyncNever {
+		err = dw.flush()
+	} else {
+		err = dw.sync()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing file: %v", err)
+	}
+	pr.stop()
+	if res.Gaps > 0 {
+		infof("Warning: recovered from %d gaps in the chunk sequence during retrieval", res.Gaps)
+	}
+	if err := fd.Close(); err != nil {
+		return 0, fmt.Errorf("error writing file: %v", err)
+	}
+	if resumable {
+		os.Remove(stateFile)
+	}
+	// When following we only learn the original name and time from the trailer.
+	if tm = res.Meta; gopts.follow && tm != nil && named == stream {
+		if name := gopts.destPath(tm.LocalName()); tm.LocalName() != "" && name != dest {
+			if _, err := os.Stat(name); os.IsNotExist(err) && os.Rename(dest, name) == nil {
+				dest = name
+			} else {
+				infof("Leaving retrieved file as %q, %q already exists", dest, name)
+			}
+		}
+		mtime = tm.ModTime
+	}
+	if tm != nil && !window {
+		if err := xfer.RestoreMode(dest, tm.Mode); err != nil {
+			log.Printf("Error setting mode of %q: %v", dest, err)
+		}
+	}
+	if !mtime.IsZero() && !window {
+		if err := os.Chtimes(dest, mtime, mtime); err != nil {
+			log.Printf("Error setting modification time of %q: %v", dest, err)
+		}
+	}
+	if elapsed := time.Since(start); jsonOutput {
+		printReport("get", stream, dest, res, elapsed)
+	} else {
+		infof("Completed retrieval of %v as %q%s in %v%s, %d gap recoveries",
+			friendlyBytes(int(res.Bytes)), dest, typeOf(res.Meta), elapsed, rateOf(res, elapsed), res.Gaps)
+	}
+	if ct != nil {
+		if err := ct.report(gopts.chunkTiming); err != nil {
+			return 0, err
+		}
+	}
+	// With -rm we only delete what we were asked for, since the contents of
+	// a reference may be shared with others.
+	if gopts.rm {
+		return int(res.Bytes), removeStream(js, stream)
+	}
+	return int(res.Bytes), nil
+}
 
+// dryRunGet reports what retrieving stream as dest would do, returning the
+// size of the transfer, or an error if dest is in the way.
+func dryRunGet(stream string, tm *xfer.Meta, dest string, gopts *getOptions) (int, error) {
+	what, size := "file", "of unknown size"
+	var n int64
+	if tm != nil {
+		if tm.Dir || tm.Tar && !gopts.tar {
+			what = "directory"
+		}
+		n, size = tm.Size, friendlyBytes(int(tm.Size))
+	}
+	action := "Would get"
+	if fi, err := os.Stat(dest); err == nil {
+		_, serr := os.Stat(dest + resumeSuffix)
+		switch {
+		case what == "file" && gopts.resume && serr == nil:
+			action = "Would resume"
+		case what == "file" && gopts.force && fi.Mode().IsRegular():
+			action = "Would replace"
+		default:
+			return 0, fmt.Errorf("destination %s %w: %s", what, xfer.ErrExists, dest)
+		}
+	}
+	log.Printf("%s %s %q, %s, from stream %q", action, what, dest, size, stream)
+	return int(n), nil
+}
+
+// getDir retrieves a directory transfer, or extracts a tar archive of one,
+// recreating the tree as dest.
+func getDir(ctx context.Context, js nats.JetStreamContext, stream string, tm *xfer.Meta, dest string, gopts *getOptions) (int, error) {
+	pr := startProgress(gopts.progressVerb(dest), 0, 0)
+	defer pr.stop()
+	get := xfer.GetDir
+	if tm.Tar {
+		get = xfer.GetTar
+	}
 	start := time.Now()
-	bytes, last, eseq := 0, si.State.Msgs, uint64(1)
+	res, err := get(ctx, js, dest, xfer.GetOptions{
+		Stream:        stream,
+		Verify:        gopts.verify,
+		MaxGapRetries: gopts.maxGapRetries,
+		NoRecover:     gopts.noRecover,
+		Sync:          gopts.fsync != fsyncNever,
+		Passphrase:    gopts.passphrase,
+		Rate:          gopts.rate,
+		Mode:          gopts.mode,
+		MaxAckPending: gopts.maxAckPending,
+		Progress:      pr.update,
+		Logf:          noticef,
+		Statusf:       statusf,
+		Debugf:        debugf,
+	})
+	// The directory is ours, since GetDir and GetTar refuse one that exists.
+	if err != nil && ctx.Err() != nil && !gopts.keepPartial {
+		pr.stop()
+		if err := os.RemoveAll(dest); err != nil {
+			log.Printf("Error removing partial directory %q: %v", dest, err)
+		} else {
+			infof("Removed partial directory %q, use -keep-partial to keep it", dest)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	pr.stop()
+	if res.Gaps > 0 {
+		infof("Warning: recovered from %d gaps in the chunk sequence during retrieval", res.Gaps)
+	}
+	if elapsed := time.Since(start); jsonOutput {
+		printReport("get", stream, dest, res, elapsed)
+	} else {
+		infof("Completed retrieval of %d files, %v, as %q in %v%s, %d gap recoveries",
+			res.Files, friendlyBytes(int(res.Bytes)), dest, elapsed, rateOf(res, elapsed), res.Gaps)
+	}
+	if gopts.rm {
+		return int(res.Bytes), removeStream(js, stream)
+	}
+	return int(res.Bytes), nil
+}
 
-	// Loop over our inbound messages.
-	for m, err := sub.NextMsg(5 * time.Second); err == nil; m, err = sub.NextMsg(time.Second) {
-		meta, err := m.Metadata()
-		if err != nil {
-			log.Fatal(err)
+// discardFile deals with the partial file of an interrupted get. Unless we
+// keep it, it is removed along with its resume state. When we keep it what
+// was written is flushed, so a resume can pick up from the last checkpoint.
+func discardFile(dw *destWriter, dest, stateFile string, keep bool) {
+	if keep {
+		if err := dw.flush(); err != nil {
+			log.Printf("Error writing partial file %q: %v", dest, err)
 		}
-		if eseq != meta.Sequence.Stream {
-			log.Printf("Missed chunk sequence, expected %d but got %d, resetting", eseq, meta.Sequence.Stream)
-			sub = createSub(eseq)
-			continue
+		if _, err := os.Stat(stateFile); err == nil {
+			infof("Kept partial file %q, use -resume to continue", dest)
+		} else {
+			infof("Kept partial file %q", dest)
+		}
+		return
+	}
+	dw.fd.Close()
+	os.Remove(stateFile)
+	if err := os.Remove(dest); err != nil {
+		log.Printf("Error removing partial file %q: %v", dest, err)
+		return
+	}
+	infof("Removed partial file %q, use -keep-partial to keep it", dest)
+}
+
+// removeStream deletes a transfer's stream along with any aliases for it.
+func removeStream(js nats.JetStreamContext, stream string) error {
+	if err := js.DeleteStream(stream); err != nil {
+		return fmt.Errorf("error deleting stream %q: %v", stream, err)
+	}
+	aliases, err := loadAliases(js)
+	if err != nil {
+		return fmt.Errorf("error loading aliases: %v", err)
+	}
+	for alias, ae := range aliases {
+		if ae.stream == stream {
+			if err := removeAlias(js, alias); err != nil {
+				return fmt.Errorf("error removing alias %q: %v", alias, err)
+			}
 		}
+	}
+	infof("Deleted stream %q", stream)
+	return nil
+}
 
-		// Write to our file.
-		fd.Write(m.Data)
-		bytes += len(m.Data)
+// destWriter writes a retrieved file, optionally buffered and fanned out to
+// stdout, syncing after every write when asked to.
+type destWriter struct {
+	fd         *os.File
+	bw         *bufio.Writer
+	w          io.Writer
+	syncAlways bool
+}
 
-		// Check to see if we are done.
-		eseq++
-		if eseq > last {
-			break
+func (dw *destWriter) Write(p []byte) (int, error) {
+	n, err := dw.w.Write(p)
+	if err == nil && dw.syncAlways {
+		err = dw.sync()
+	}
+	return n, err
+}
+
+// WriteAt writes straight to the file, which is how the regions of a
+// parallel transfer are placed at their offsets.
+func (dw *destWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := dw.fd.WriteAt(p, off)
+	if err == nil && dw.syncAlways {
+		err = dw.fd.Sync()
+	}
+	return n, err
+}
+
+// Seek writes out anything buffered and seeks in the file, which is how a
+// window of chunks is placed at its offset.
+func (dw *destWriter) Seek(offset int64, whence int) (int64, error) {
+	if err := dw.flush(); err != nil {
+		return 0, err
+	}
+	return dw.fd.Seek(offset, whence)
+}
+
+// flush writes out anything buffered.
+func (dw *destWriter) flush() error {
+	if dw.bw != nil {
+		return dw.bw.Flush()
+	}
+	return nil
+}
+
+// sync flushes and syncs the file to disk.
+func (dw *destWriter) sync() error {
+	if err := dw.flush(); err != nil {
+		return err
+	}
+	return dw.fd.Sync()
+}
+
+// namedWriter includes the name of its destination in any write errors.
+type namedWriter struct {
+	name string
+	w    io.Writer
+}
+
+func (nw *namedWriter) Write(p []byte) (int, error) {
+	n, err := nw.w.Write(p)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", nw.name, err)
+	}
+	return n, err
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
+
+// parseSize parses a size such as "64k" or "1m" into bytes.
+func parseSize(size string) (int, error) {
+	s := strings.ToLower(strings.TrimSpace(size))
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1024, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult, s = 1024*1024, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		mult, s = 1024*1024*1024, strings.TrimSuffix(s, "g")
 	}
-	log.Printf("Completed retrieval of %v in %v", friendlyBytes(bytes), time.Since(start))
-	fd.Close()
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
 }
 
 func friendlyBytes(bytes int) string {
@@ -234,20 +2235,54 @@ func friendlyBytes(bytes int) string {
 	return fmt.Sprintf("%.2f %sB", fbytes/math.Pow(float64(base), float64(exp)), pre[index])
 }
 
-func setupConnOptions(opts []nats.Option) []nats.Option {
-	totalWait := 10 * time.Second
-	reconnectDelay := time.Second
+// tlsOptions returns the options to connect with TLS, if any of the files
+// are given or we are to skip verifying the server.
+func tlsOptions(cert, key, ca string, skipVerify bool) ([]nats.Option, error) {
+	if (cert == "") != (key == "") {
+		return nil, errors.New("a TLS client certificate and key must be given together")
+	}
+	if cert == "" && ca == "" && !skipVerify {
+		return nil, nil
+	}
+	if skipVerify {
+		infof("Warning: not verifying the server's TLS certificate, this is insecure")
+	}
+	// The CA and client certificate are added to this configuration.
+	opts := []nats.Option{nats.Secure(&tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: skipVerify})}
+	if ca != "" {
+		opts = append(opts, nats.RootCAs(ca))
+	}
+	if cert != "" {
+		opts = append(opts, nats.ClientCert(cert, key))
+	}
+	return opts, nil
+}
 
-	opts = append(opts, nats.ReconnectWait(reconnectDelay))
-	opts = append(opts, nats.MaxReconnects(int(totalWait/reconnectDelay)))
+// setupConnOptions makes us reconnect up to maxReconnects times, or forever
+// if negative, waiting reconnectWait between attempts.
+func setupConnOptions(opts []nats.Option, maxReconnects int, reconnectWait time.Duration) []nats.Option {
+	opts = append(opts, nats.ReconnectWait(reconnectWait))
+	opts = append(opts, nats.MaxReconnects(maxReconnects))
 	opts = append(opts, nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-		log.Printf("Disconnected due to: %s, will attempt reconnects for %.0fs", err, totalWait.Minutes())
+		if err == nil {
+			return
+		}
+		if maxReconnects < 0 {
+			statusf("Disconnected due to: %s, will keep attempting reconnects", err)
+		} else {
+			statusf("Disconnected due to: %s, will attempt reconnects for %.0fs", err, (time.Duration(maxReconnects) * reconnectWait).Seconds())
+		}
 	}))
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
-		log.Printf("Reconnected [%s]", nc.ConnectedUrl())
+		statusf("Reconnected [%s]", nc.ConnectedUrl())
 	}))
+	// Exiting here could cut a transfer short, instead we report why the
+	// connection closed and let anything in flight fail, see withConnClosed.
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
-		log.Fatalf("Exiting: %v", nc.LastError())
+		if err := nc.LastError(); err != nil {
+			log.Printf("Connection closed: %v", err)
+		}
+		connClosedOnce.Do(func() { close(connClosed) })
 	}))
 	return opts
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runServer starts an embedded server with JetStream and connects to it.
+// Both are shut down with the test.
+func runServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("Server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestCanonicalName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	for _, tc := range []struct {
+		name, stream string
+	}{
+		// Names that are valid stream names are used as is.
+		{"Makefile", "Makefile"},
+		{"/some/dir/Makefile", "Makefile"},
+		{"README", "README"},
+		{"no-extension_1", "no-extension_1"},
+		// Hidden files do not collide with the sanitized name.
+		{".bashrc", "_bashrc_b7cf3e96"},
+		{"_bashrc", "_bashrc"},
+		// Multiple dots.
+		{"foo.tar.gz", "foo_tar_gz_cf051bf6"},
+		{"foo_tar_gz", "foo_tar_gz"},
+		{"x.y.z", "x_y_z_f7304f12"},
+		// Spaces.
+		{"my file.txt", "my_file_txt_bd031735"},
+		{"/tmp/my file.txt", "my_file_txt_bd031735"},
+		// Long names keep a readable prefix.
+		{long, strings.Repeat("a", maxNamePrefix) + "_6bd5e503"},
+	} {
+		stream := canonicalName(tc.name)
+		if stream != tc.stream {
+			t.Errorf("canonicalName(%q) = %q, expected %q", tc.name, stream, tc.stream)
+		}
+		if !validStreamName(stream) {
+			t.Errorf("canonicalName(%q) = %q, which is not a valid stream name", tc.name, stream)
+		}
+	}
+}
+
+func TestLegacyName(t *testing.T) {
+	for _, tc := range []struct {
+		name, stream string
+	}{
+		{"Makefile", "Makefile"},
+		{".bashrc", "_bashrc"},
+		{"foo.tar.gz", "foo_tar_gz"},
+		{"/tmp/my file.txt", "my_file_txt"},
+	} {
+		if stream := legacyName(tc.name); stream != tc.stream {
+			t.Errorf("legacyName(%q) = %q, expected %q", tc.name, stream, tc.stream)
+		}
+	}
+}
+
+func TestResolveLegacyStream(t *testing.T) {
+	nc := runServer(t)
+	js := newJetStream(nc)
+	addStream := func(name string) {
+		t.Helper()
+		if _, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{"test." + name}}); err != nil {
+			t.Fatalf("Error creating stream %q: %v", name, err)
+		}
+	}
+	resolve := func(name string) string {
+		t.Helper()
+		stream, err := resolveStream(js, name)
+		if err != nil {
+			t.Fatalf("Error resolving %q: %v", name, err)
+		}
+		return stream
+	}
+
+	// Without either stream we use the new name.
+	if stream := resolve("my file.txt"); stream != "my_file_txt_bd031735" {
+		t.Fatalf("Resolved %q without streams, expected the new name", stream)
+	}
+	// A transfer put by an earlier version is found by its old name.
+	addStream("my_file_txt")
+	if stream := resolve("my file.txt"); stream != "my_file_txt" {
+		t.Fatalf("Resolved %q, expected the legacy stream", stream)
+	}
+	// Once the new stream exists it is preferred.
+	addStream("my_file_txt_bd031735")
+	if stream := resolve("my file.txt"); stream != "my_file_txt_bd031735" {
+		t.Fatalf("Resolved %q, expected the new stream", stream)
+	}
+	// Names that need no sanitizing never fall back.
+	if stream := resolve("Makefile"); stream != "Makefile" {
+		t.Fatalf("Resolved %q, expected Makefile", stream)
+	}
+}
+
+func TestGetEmptyFile(t *testing.T) {
+	nc := runServer(t)
+	js := newJetStream(nc)
+	dir := t.TempDir()
+	// An empty file, and a stream whose put was stopped before sending
+	// anything, are both retrieved as an empty file.
+	empty := filepath.Join(dir, "empty.txt")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := putFile(context.Background(), nc, empty, &putOptions{}); err != nil {
+		t.Fatalf("Error putting %q: %v", empty, err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "stopped", Subjects: []string{"stopped"}}); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	for _, tc := range []struct {
+		name, stream, dest string
+	}{
+		{empty, "", "empty.txt"},
+		{"", "stopped", "stopped"},
+	} {
+		out := t.TempDir()
+		start := time.Now()
+		n, err := getFile(context.Background(), nc, tc.name, &getOptions{stream: tc.stream, output: out})
+		if err != nil {
+			t.Fatalf("Error getting %q: %v", tc.dest, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Getting %q took %v", tc.dest, elapsed)
+		}
+		fi, err := os.Stat(filepath.Join(out, tc.dest))
+		if err != nil || n != 0 || fi.Size() != 0 {
+			t.Fatalf("Expected an empty %q, got %d bytes: %v", tc.dest, n, err)
+		}
+	}
+}
+
+func TestStrictMetadata(t *testing.T) {
+	nc := runServer(t)
+	js := newJetStream(nc)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "strict.txt")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := putFile(context.Background(), nc, path, &putOptions{}); err != nil {
+		t.Fatalf("Error putting %q: %v", path, err)
+	}
+	stream := canonicalName(path)
+	si, err := xfer.LookupStream(js, stream)
+	if err != nil {
+		t.Fatalf("Error looking up stream %q: %v", stream, err)
+	}
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil || tm == nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+
+	// Streams with the chunk of the file and a damaged copy of its trailer.
+	for _, tc := range []struct {
+		stream string
+		damage func(hdr http.Header)
+	}{
+		{"no_trailer", nil},
+		{"legacy", func(hdr http.Header) { hdr.Del(xfer.HeaderComplete) }},
+		{"no_digest", func(hdr http.Header) { hdr.Set(xfer.HeaderDigest, "unknown") }},
+		{"no_size", func(hdr http.Header) { hdr.Set(xfer.HeaderSize, "-1") }},
+		{"no_chunk_size", func(hdr http.Header) { hdr.Set(xfer.HeaderChunkSize, "0") }},
+	} {
+		if _, err := js.AddStream(&nats.StreamConfig{Name: tc.stream, Subjects: []string{tc.stream}}); err != nil {
+			t.Fatalf("Error creating stream: %v", err)
+		}
+		if _, err := js.Publish(tc.stream, []byte("hello")); err != nil {
+			t.Fatalf("Error publishing: %v", err)
+		}
+		if tc.damage != nil {
+			m := nats.NewMsg(tc.stream)
+			m.Header = tm.Header()
+			tc.damage(m.Header)
+			if _, err := js.PublishMsg(m); err != nil {
+				t.Fatalf("Error publishing: %v", err)
+			}
+		}
+		_, err := getFile(context.Background(), nc, "", &getOptions{stream: tc.stream, output: t.TempDir(), strict: true})
+		if err == nil || !strings.Contains(err.Error(), tc.stream) {
+			t.Errorf("Get of %q was not refused: %v", tc.stream, err)
+		}
+		if err := verifyStream(nc, tc.stream, "", true); err == nil {
+			t.Errorf("Verify of %q was not refused", tc.stream)
+		}
+	}
+
+	// Complete metadata passes.
+	if _, err := getFile(context.Background(), nc, path, &getOptions{output: t.TempDir(), strict: true}); err != nil {
+		t.Fatalf("Error getting %q: %v", path, err)
+	}
+	if err := verifyStream(nc, stream, "", true); err != nil {
+		t.Fatalf("Error verifying %q: %v", stream, err)
+	}
+}
+
+func TestDedupFiles(t *testing.T) {
+	nc := runServer(t)
+	dir := t.TempDir()
+	data := []byte(strings.Repeat("duplicate contents\n", 100))
+	var files []string
+	for _, name := range []string{"first.txt", "second.txt", "third.txt"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	// The duplicates refer to the stream holding the contents, whatever
+	// it is named.
+	for _, popts := range []*putOptions{{dedup: true}, {dedup: true, cas: true}} {
+		js := newJetStream(nc)
+		for _, path := range files {
+			js.DeleteStream(canonicalName(path))
+		}
+		if err := putFiles(context.Background(), nc, files, popts, true); err != nil {
+			t.Fatalf("Error putting files, cas %v: %v", popts.cas, err)
+		}
+		// With -cas the first is only found by its digest.
+		refs := files
+		if popts.cas {
+			refs = files[1:]
+		}
+		for _, path := range refs {
+			out := t.TempDir()
+			if _, err := getFile(context.Background(), nc, path, &getOptions{output: out}); err != nil {
+				t.Fatalf("Error getting %q: %v", path, err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(out, filepath.Base(path)))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("Retrieved %d bytes of %q that differ from the %d put: %v", len(got), path, len(data), err)
+			}
+		}
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	nc := runServer(t)
+	dir := t.TempDir()
+	file := func(name, contents string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b, c, d := file("a.txt", "a"), file("b.txt", "b"), file("c.txt", "c"), file("d.txt", "d")
+	c2 := file("c2.txt", "c")
+	for _, path := range []string{a, b} {
+		if _, err := putFile(context.Background(), nc, path, &putOptions{}); err != nil {
+			t.Fatalf("Error putting %q: %v", path, err)
+		}
+		if _, err := putFile(context.Background(), nc, path, &putOptions{cas: true}); err != nil {
+			t.Fatalf("Error putting %q: %v", path, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		files []string
+		popts *putOptions
+		ok    bool
+	}{
+		{"new", []string{c}, &putOptions{}, true},
+		{"too_many", []string{c, d}, &putOptions{}, false},
+		// Streams that exist are not created again.
+		{"overwrite", []string{a, b, c}, &putOptions{overwrite: true}, true},
+		{"append", []string{a, b, c}, &putOptions{append: true}, true},
+		{"allow_existing", []string{a, b, c}, &putOptions{allowExisting: true}, true},
+		// Nor are those holding the same contents.
+		{"cas", []string{a, b, c, c2}, &putOptions{cas: true}, true},
+		{"cas_too_many", []string{a, c, d}, &putOptions{cas: true}, false},
+	} {
+		err := checkStreamLimit(nc, tc.files, tc.popts, 1)
+		if tc.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if !tc.ok && (err == nil || !strings.Contains(err.Error(), "-tar")) {
+			t.Errorf("%s: expected the limit to be exceeded, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestHashedSubjects(t *testing.T) {
+	nc := runServer(t)
+	js := newJetStream(nc)
+	// Two different files with the same base name.
+	var files []string
+	for i, dir := range []string{t.TempDir(), t.TempDir()} {
+		path := filepath.Join(dir, "x")
+		if err := ioutil.WriteFile(path, []byte(strings.Repeat("x", i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	for _, tc := range []struct {
+		name  string
+		popts []*putOptions
+	}{
+		{"name", []*putOptions{{name: "a", subjFromHash: true}, {name: "b", subjFromHash: true}}},
+		{"cas", []*putOptions{{cas: true, subjFromHash: true}, {cas: true, subjFromHash: true}}},
+	} {
+		subjects := make(map[string]bool)
+		for i, path := range files {
+			res, err := putFile(context.Background(), nc, path, tc.popts[i])
+			if err != nil {
+				t.Fatalf("%s: error putting %q: %v", tc.name, path, err)
+			}
+			si, err := js.StreamInfo(res.Stream)
+			if err != nil {
+				t.Fatalf("%s: error looking up stream %q: %v", tc.name, res.Stream, err)
+			}
+			subjects[si.Config.Subjects[0]] = true
+		}
+		if len(subjects) != 2 {
+			t.Fatalf("%s: expected the streams to have different subjects, got %v", tc.name, subjects)
+		}
+	}
+}
+
+func TestDumpSettings(t *testing.T) {
+	fs := flag.NewFlagSet("njs-xfer", flag.ContinueOnError)
+	fs.String("s", "localhost", "")
+	fs.String("token", "secret", "")
+	fs.Bool("dump-config", true, "")
+	defer func(j bool) { jsonOutput = j }(jsonOutput)
+
+	var buf bytes.Buffer
+	jsonOutput = false
+	if err := dumpSettings(&buf, fs); err != nil {
+		t.Fatalf("Error dumping settings: %v", err)
+	}
+	if strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "dump-config") {
+		t.Fatalf("Unexpected settings:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	jsonOutput = true
+	if err := dumpSettings(&buf, fs); err != nil {
+		t.Fatalf("Error dumping settings: %v", err)
+	}
+	var settings map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &settings); err != nil {
+		t.Fatalf("Expected a JSON object, got %q: %v", buf.String(), err)
+	}
+	want := map[string]string{"s": "localhost", "token": "<redacted>"}
+	if len(settings) != len(want) || settings["s"] != want["s"] || settings["token"] != want["token"] {
+		t.Fatalf("Expected %v, got %v", want, settings)
+	}
+}
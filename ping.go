@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// pingReport is what ping prints with -json.
+type pingReport struct {
+	URL        string `json:"url"`
+	ServerID   string `json:"server_id"`
+	ServerName string `json:"server_name,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Cluster    string `json:"cluster,omitempty"`
+	RTTMicros  int64  `json:"rtt_us"`
+	MaxPayload int64  `json:"max_payload"`
+	JetStream  bool   `json:"jetstream"`
+	// The account's JetStream usage and limits, when it is enabled. Limits
+	// of -1 are unlimited.
+	Account *nats.AccountInfo `json:"account,omitempty"`
+}
+
+// pingServer checks that we can reach the server and use JetStream, and
+// reports what a transfer is up against: the maximum payload, which bounds
+// the chunk size, and the account's usage and limits.
+func pingServer(nc *nats.Conn) error {
+	r := pingReport{
+		URL:        nc.ConnectedUrl(),
+		ServerID:   nc.ConnectedServerId(),
+		ServerName: nc.ConnectedServerName(),
+		Cluster:    nc.ConnectedClusterName(),
+		MaxPayload: nc.MaxPayload(),
+	}
+	rtt, err := nc.RTT()
+	if err != nil {
+		return fmt.Errorf("error measuring round trip time: %v", err)
+	}
+	r.RTTMicros = rtt.Microseconds()
+	if r.Version, err = serverVersion(r.URL); err != nil {
+		debugf("Error reading server version: %v", err)
+	}
+
+	// A missing JetStream is still reported, and then fails the ping.
+	js, jsErr := jetStream(nc)
+	if jsErr == nil {
+		r.Account, jsErr = js.AccountInfo()
+	}
+	if jsErr == nil {
+		r.JetStream = true
+	} else if errors.Is(jsErr, nats.ErrJetStreamNotEnabled) && jsDomain != "" {
+		jsErr = fmt.Errorf("JetStream not enabled for domain %q", jsDomain)
+	} else if errors.Is(jsErr, nats.ErrJetStreamNotEnabled) {
+		jsErr = errors.New("JetStream not enabled for this account")
+	} else {
+		jsErr = fmt.Errorf("error retrieving account info: %v", jsErr)
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+			return fmt.Errorf("error writing report: %v", err)
+		}
+		return jsErr
+	}
+	server := r.ServerID
+	if r.ServerName != "" {
+		server = r.ServerName
+	}
+	if r.Version != "" {
+		server += ", version " + r.Version
+	}
+	if r.Cluster != "" {
+		server += ", cluster " + r.Cluster
+	}
+	fmt.Printf("Connected to %s (%s), round trip %v\n", r.URL, server, rtt)
+	fmt.Printf("Maximum payload: %s\n", friendlyBytes(int(r.MaxPayload)))
+	if jsErr != nil {
+		return jsErr
+	}
+	ai := r.Account
+	fmt.Printf("JetStream: %d streams, %d consumers, %s file and %s memory storage in use\n",
+		ai.Streams, ai.Consumers, friendlyBytes(int(ai.Store)), friendlyBytes(int(ai.Memory)))
+	fmt.Printf("Limits: %s streams, %s consumers, %s file and %s memory storage\n",
+		limitString(int64(ai.Limits.MaxStreams), false), limitString(int64(ai.Limits.MaxConsumers), false),
+		limitString(ai.Limits.MaxStore, true), limitString(ai.Limits.MaxMemory, true))
+	return nil
+}
+
+// limitString describes an account limit, where a negative one is unlimited.
+func limitString(n int64, bytes bool) string {
+	switch {
+	case n < 0:
+		return "unlimited"
+	case bytes:
+		return friendlyBytes(int(n))
+	}
+	return fmt.Sprint(n)
+}
+
+// serverVersion reads the version from the INFO the server greets every
+// connection with, which the client library does not expose. The greeting
+// comes before any TLS handshake, so we only need a plain connection.
+func serverVersion(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return "", fmt.Errorf("unexpected greeting from %s", u.Host)
+	}
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// pipeCommand is a shell command that get writes the file to instead of a
+// file, so retrieval overlaps with processing it, e.g. "gunzip > out".
+type pipeCommand struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	// broken is set once the command stops reading its input.
+	broken bool
+	done   bool
+}
+
+// commandError is a command that failed, whose exit code becomes ours.
+type commandError struct {
+	command string
+	code    int
+}
+
+func (ce *commandError) Error() string {
+	return fmt.Sprintf("command %q exited with status %d", ce.command, ce.code)
+}
+
+// startPipe starts the command with its stdin as a pipe for us to write to.
+// Its stdout and stderr are ours.
+func startPipe(command string) (*pipeCommand, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %q: %v", command, err)
+	}
+	return &pipeCommand{command: command, cmd: cmd, stdin: stdin}, nil
+}
+
+func (pc *pipeCommand) Write(p []byte) (int, error) {
+	n, err := pc.stdin.Write(p)
+	if err != nil {
+		pc.broken = true
+	}
+	return n, err
+}
+
+// close ends the command's input and waits for it to finish.
+func (pc *pipeCommand) close() error {
+	if pc.done {
+		return nil
+	}
+	pc.done = true
+	pc.stdin.Close()
+	return pc.wait()
+}
+
+// abort stops the command without ending its input, so a partial file is
+// never mistaken for a whole one.
+func (pc *pipeCommand) abort() {
+	if pc.done {
+		return
+	}
+	pc.done = true
+	pc.cmd.Process.Kill()
+	pc.stdin.Close()
+	pc.cmd.Wait()
+}
+
+// failed deals with a get that failed with err. If the command stopped
+// reading, its own failure explains ours, otherwise it is aborted.
+func (pc *pipeCommand) failed(err error) error {
+	if !pc.broken {
+		pc.abort()
+		return err
+	}
+	if cerr := pc.close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (pc *pipeCommand) wait() error {
+	err := pc.cmd.Wait()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() > 0 {
+		return &commandError{pc.command, ee.ExitCode()}
+	} else if err != nil {
+		return fmt.Errorf("command %q failed: %v", pc.command, err)
+	}
+	return nil
+}
+
+// pipeFile retrieves stream into the command of -pipe, which is only given
+// the whole file once it has exited successfully. It returns the number of
+// bytes retrieved.
+func pipeFile(ctx context.Context, js nats.JetStreamContext, stream string, gopts *getOptions) (int, error) {
+	pc, err := startPipe(gopts.pipe)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.abort()
+
+	pr := startProgress(gopts.progressVerb(stream), 0, 0)
+	defer pr.stop()
+
+	xopts := gopts.xferOptions(stream, pr.update)
+	var ct *chunkTimer
+	if gopts.chunkTiming != "" {
+		ct = &chunkTimer{}
+		xopts.OnChunk = ct.add
+	}
+
+	start := time.Now()
+	res, err := xfer.Get(ctx, js, &namedWriter{"pipe", pc}, xopts)
+	if err != nil {
+		pr.stop()
+		return 0, pc.failed(err)
+	}
+	pr.stop()
+	if err := pc.close(); err != nil {
+		return 0, err
+	}
+	if res.Gaps > 0 {
+		infof("Warning: recovered from %d gaps in the chunk sequence during retrieval", res.Gaps)
+	}
+	if elapsed := time.Since(start); jsonOutput {
+		printReport("get", stream, "", res, elapsed)
+	} else {
+		infof("Completed retrieval of %v into %q%s in %v%s, %d gap recoveries",
+			friendlyBytes(int(res.Bytes)), gopts.pipe, typeOf(res.Meta), elapsed, rateOf(res, elapsed), res.Gaps)
+	}
+	if ct != nil {
+		if err := ct.report(gopts.chunkTiming); err != nil {
+			return 0, err
+		}
+	}
+	if gopts.rm {
+		return int(res.Bytes), removeStream(js, stream)
+	}
+	return int(res.Bytes), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// How often progress is reported on a terminal, where the status line is
+// updated in place, and otherwise, where each report is a line of its own.
+const (
+	progressInterval       = time.Second
+	progressIntervalNoTerm = 10 * time.Second
+)
+
+// progress periodically reports how far a transfer has got on the status
+// line, with the current rate and, when the total is known, the percentage
+// done and an estimate of the time remaining. Transfers keep it up to date
+// through update, their xfer.ProgressFunc, and anything else through add.
+type progress struct {
+	verb  string
+	total int64
+	bytes int64
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// startProgress starts reporting. Total is 0 or less when it is not known,
+// and bytes is how much was already transferred, e.g. when resuming.
+func startProgress(verb string, bytes, total int64) *progress {
+	p := &progress{
+		verb:  verb,
+		total: total,
+		bytes: bytes,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	// With -json stdout is for the report, and progress would only get in
+	// the way of parsing what we log.
+	if jsonOutput {
+		close(p.done)
+		return p
+	}
+	interval := progressInterval
+	if !status.tty {
+		interval = progressIntervalNoTerm
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last, lastTime := bytes, time.Now()
+		for {
+			select {
+			case <-p.quit:
+				return
+			case now := <-ticker.C:
+				n, total := atomic.LoadInt64(&p.bytes), atomic.LoadInt64(&p.total)
+				rate := float64(n-last) / now.Sub(lastTime).Seconds()
+				status.update("%s", p.line(n, total, rate))
+				last, lastTime = n, now
+			}
+		}
+	}()
+	return p
+}
+
+// add records more bytes transferred.
+func (p *progress) add(n int) {
+	atomic.AddInt64(&p.bytes, int64(n))
+}
+
+// update records how much of the total has been transferred.
+func (p *progress) update(bytes, total int64) {
+	atomic.StoreInt64(&p.bytes, bytes)
+	atomic.StoreInt64(&p.total, total)
+}
+
+// stop stops reporting and removes the status line.
+func (p *progress) stop() {
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+	close(p.quit)
+	<-p.done
+	status.clear()
+}
+
+// line formats a report for n of total bytes at the given rate in bytes
+// per second.
+func (p *progress) line(n, total int64, rate float64) string {
+	if total <= 0 {
+		return fmt.Sprintf("%s %s, %s/s", p.verb, friendlyBytes(int(n)), friendlyBytes(int(rate)))
+	}
+	eta := "unknown"
+	if rate > 0 && n < total {
+		eta = time.Duration(float64(total-n) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s %s of %s (%d%%), %s/s, ETA %s", p.verb, friendlyBytes(int(n)), friendlyBytes(int(total)),
+		n*100/total, friendlyBytes(int(rate)), eta)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// recoverStream rebuilds the metadata for a stream whose chunks are intact but
+// whose metadata is missing or damaged, e.g. after a server migration or when
+// the stream was created by hand. The size and digest are computed by scanning
+// the chunks and a new trailer is appended, superseding any existing ones.
+// Afterwards the stream can be retrieved with get as usual.
+func recoverStream(nc *nats.Conn, stream, fileName string, chunkSize int) error {
+	js := newJetStream(nc)
+
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	if si.State.Msgs == 0 {
+		return fmt.Errorf("stream %q is empty, nothing to recover", stream)
+	}
+	// Its chunks are not in the order of the file, and its regions would
+	// each need a digest.
+	if xfer.IsParallel(si) {
+		return fmt.Errorf("stream %q is from a parallel put, its metadata can not be recovered", stream)
+	}
+	if fileName == "" {
+		fileName = stream
+	}
+
+	sub, err := js.SubscribeSync(
+		si.Config.Subjects[0],
+		nats.AckNone(),
+		nats.DeliverAll(),
+		nats.EnableFlowControl(),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating consumer: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Scan the stream, hashing the chunks and skipping any old trailers.
+	h := sha256.New()
+	var size int64
+	var subj, compression, encryption, salt string
+	short := uint64(0)
+	for {
+		m, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			return fmt.Errorf("error scanning stream %q: %v", stream, err)
+		}
+		meta, err := m.Metadata()
+		if err != nil {
+			return err
+		}
+		seq := meta.Sequence.Stream
+		if m.Header.Get(xfer.HeaderEntry) != "" {
+			return fmt.Errorf("stream %q holds a directory, which can not be recovered", stream)
+		}
+		if m.Header.Get(xfer.HeaderMeta) == "" {
+			data, err := decrypter.ChunkData(m.Header, m.Data)
+			if err != nil {
+				return fmt.Errorf("error reading chunk at sequence %d: %v", seq, err)
+			}
+			// Only the last chunk may be shorter than the chunk size.
+			if short != 0 || len(data) > chunkSize {
+				return fmt.Errorf("chunk at sequence %d does not match a chunk size of %d", seq, chunkSize)
+			}
+			if len(data) < chunkSize {
+				short = seq
+			}
+			h.Write(data)
+			size += int64(len(data))
+			subj = m.Subject
+			if c := m.Header.Get(xfer.HeaderCompression); c != "" {
+				compression = c
+			}
+			if e := m.Header.Get(xfer.HeaderEncryption); e != "" {
+				encryption, salt = e, m.Header.Get(xfer.HeaderSalt)
+			}
+		}
+		if seq >= si.State.LastSeq {
+			break
+		}
+	}
+	if subj == "" {
+		return fmt.Errorf("stream %q has no chunks, nothing to recover", stream)
+	}
+
+	tm := &xfer.Meta{
+		Name:        fileName,
+		Size:        size,
+		ChunkSize:   chunkSize,
+		Digest:      hex.EncodeToString(h.Sum(nil)),
+		Completion:  xfer.CompletionTrailer,
+		Compression: compression,
+		Encryption:  encryption,
+		Salt:        salt,
+	}
+	mm := nats.NewMsg(subj)
+	mm.Header = tm.Header()
+	if _, err := js.PublishMsg(mm); err != nil {
+		return fmt.Errorf("error writing metadata: %v", err)
+	}
+	infof("Recovered metadata for %q, %v in %q", stream, friendlyBytes(int(size)), fileName)
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// putRef records fileName as a transfer whose contents are already stored in
+// another stream. Its stream holds just a trailer, with the metadata of the
+// other transfer under its own name and a reference to the other stream.
+func putRef(nc *nats.Conn, fileName, ref string) error {
+	js := newJetStream(nc)
+	stream := canonicalName(fileName)
+	if _, err := js.StreamInfo(stream); err == nil {
+		return fmt.Errorf("stream %q %w", stream, xfer.ErrExists)
+	}
+	si, err := xfer.LookupStream(js, ref)
+	if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", ref, err)
+	}
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil {
+		return fmt.Errorf("error reading metadata for stream %q: %v", ref, err)
+	}
+	if tm == nil {
+		return fmt.Errorf("stream %q has no transfer metadata", ref)
+	}
+
+	subj := nats.NewInbox()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{subj}}); err != nil {
+		return fmt.Errorf("unexpected error creating stream: %v", err)
+	}
+	tm.Name, tm.Ref, tm.ModTime = filepath.Base(fileName), ref, time.Time{}
+	if fi, err := os.Stat(fileName); err == nil {
+		tm.ModTime = fi.ModTime()
+	}
+	m := nats.NewMsg(subj)
+	m.Header = tm.Header()
+	if _, err := js.PublishMsg(m); err != nil {
+		return fmt.Errorf("error sending metadata to JetStream: %v", err)
+	}
+	infof("Stored %q as a reference to stream %q", fileName, ref)
+	return nil
+}
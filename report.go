@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+)
+
+// jsonOutput is set by -json to report each completed transfer as a JSON
+// object on stdout, for automation, instead of as a log line.
+var jsonOutput bool
+
+// transferReport is what -json prints when a transfer completes.
+type transferReport struct {
+	Operation  string `json:"operation"`
+	Stream     string `json:"stream"`
+	File       string `json:"file"`
+	Bytes      int64  `json:"bytes"`
+	Chunks     int    `json:"chunks"`
+	Files      int    `json:"files,omitempty"`
+	Gaps       int    `json:"gaps,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Throughput int64  `json:"throughput_bytes_per_sec"`
+	// Checksum is the SHA-256 digest of the file, and ContentType its
+	// MIME type, when known.
+	Checksum    string `json:"checksum,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Window is the publish window a put settled on with -adaptive-flow.
+	Window int `json:"window,omitempty"`
+	// How long a get was stalled waiting for chunks, its throughput over
+	// the rest of the time, and the fastest chunks arrived at.
+	StalledMs           int64 `json:"stalled_ms,omitempty"`
+	EffectiveThroughput int64 `json:"effective_throughput_bytes_per_sec,omitempty"`
+	PeakThroughput      int64 `json:"peak_throughput_bytes_per_sec,omitempty"`
+}
+
+// printReport prints the report for a transfer of file in stream, one
+// object per line.
+func printReport(op, stream, file string, res *xfer.Result, elapsed time.Duration) {
+	r := transferReport{
+		Operation:  op,
+		Stream:     stream,
+		File:       file,
+		Bytes:      res.Bytes,
+		Chunks:     res.Chunks,
+		Files:      res.Files,
+		Gaps:       res.Gaps,
+		Window:     res.Window,
+		DurationMs: elapsed.Milliseconds(),
+	}
+	if s := elapsed.Seconds(); s > 0 {
+		r.Throughput = int64(float64(res.Bytes) / s)
+	}
+	if res.PeakRate > 0 {
+		r.StalledMs = res.Stalled.Milliseconds()
+		r.EffectiveThroughput = effectiveRate(res, elapsed)
+		r.PeakThroughput = res.PeakRate
+	}
+	if res.Meta != nil {
+		r.Checksum, r.ContentType = res.Meta.Digest, res.Meta.ContentType
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+		log.Printf("Error writing report: %v", err)
+	}
+}
+
+// effectiveRate is the throughput of a get over the time it was not stalled.
+func effectiveRate(res *xfer.Result, elapsed time.Duration) int64 {
+	active := elapsed - res.Stalled
+	if active <= 0 {
+		return 0
+	}
+	return int64(float64(res.Bytes) / active.Seconds())
+}
+
+// rateOf describes how fast a get went for a log line, telling time stalled
+// waiting for chunks, e.g. by flow control, apart from a slow connection.
+func rateOf(res *xfer.Result, elapsed time.Duration) string {
+	s := fmt.Sprintf(", %v/s effective, %v/s peak",
+		friendlyBytes(int(effectiveRate(res, elapsed))), friendlyBytes(int(res.PeakRate)))
+	if res.Stalled > 0 {
+		s += fmt.Sprintf(", stalled for %v", res.Stalled.Round(time.Millisecond))
+	}
+	return s
+}
+
+// typeOf describes the content type of a transfer for a log line, if known.
+func typeOf(tm *xfer.Meta) string {
+	if tm == nil || tm.ContentType == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", tm.ContentType)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+)
+
+// resumeSuffix is added to the destination file's name for its resume state.
+const resumeSuffix = ".njs-xfer-resume"
+
+// resumeState records how much of a file getFile has written, so an
+// interrupted get can be resumed with -resume instead of starting over.
+// It is kept next to the destination file until the get completes.
+type resumeState struct {
+	xfer.Position
+}
+
+// loadResumeState returns the resume state in the file, or nil if there is none.
+func loadResumeState(file string) (*resumeState, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rs resumeState
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("invalid resume state %q: %v", file, err)
+	}
+	return &rs, nil
+}
+
+// save writes the resume state, replacing the file atomically so an
+// interruption never leaves a partial state behind.
+func (rs *resumeState) save(file string) error {
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// reopen opens the partial file for writing after what was recorded,
+// discarding anything written after the state was saved.
+func (rs *resumeState) reopen(file string) (*os.File, error) {
+	fd, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Truncate(rs.Size); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if _, err := fd.Seek(rs.Size, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
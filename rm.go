@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// removeTransfers deletes the streams of the named transfers, or with all
+// every transfer in the account. Only streams created by njs-xfer are
+// removed, and unless yes is set we ask first.
+func removeTransfers(nc *nats.Conn, names []string, all, yes, dryRun bool) error {
+	js := newJetStream(nc)
+
+	var streams []string
+	var bytes uint64
+	if all {
+		tis, err := xfer.ListTransfers(js, prefixFilter())
+		if err != nil {
+			return fmt.Errorf("error listing transfers: %v", err)
+		}
+		for _, ti := range tis {
+			streams = append(streams, ti.Stream)
+			bytes += ti.Bytes
+		}
+	}
+	for _, name := range names {
+		stream, si, err := lookupTransfer(js, name)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		bytes += si.State.Bytes
+	}
+	if len(streams) == 0 {
+		infof("No transfers to remove")
+		return nil
+	}
+
+	if dryRun {
+		for _, stream := range streams {
+			infof("Would delete stream %q", stream)
+		}
+		infof("Would free %v in %d streams", friendlyBytes(int(bytes)), len(streams))
+		return nil
+	}
+	if !yes && !confirm(fmt.Sprintf("Delete %d streams holding %v?", len(streams), friendlyBytes(int(bytes)))) {
+		return fmt.Errorf("not removing anything")
+	}
+	for _, stream := range streams {
+		if err := removeStream(js, stream); err != nil {
+			return err
+		}
+	}
+	infof("Freed %v in %d streams", friendlyBytes(int(bytes)), len(streams))
+	return nil
+}
+
+// lookupTransfer resolves name, an alias, file or stream name, to its stream,
+// which must hold a transfer.
+func lookupTransfer(js nats.JetStreamContext, name string) (string, *nats.StreamInfo, error) {
+	stream, err := resolveStream(js, name)
+	if err != nil {
+		return "", nil, fmt.Errorf("error resolving %q: %v", name, err)
+	}
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return "", nil, fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return "", nil, fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	ok, err := xfer.IsTransfer(js, si)
+	if err != nil {
+		return "", nil, fmt.Errorf("error checking stream %q: %v", stream, err)
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("stream %q was not created by njs-xfer, not removing it", stream)
+	}
+	return stream, si, nil
+}
+
+// confirm asks a yes or no question on the terminal, defaulting to no.
+func confirm(question string) bool {
+	status.clear()
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log levels, set with -q and -v.
+const (
+	levelQuiet = iota
+	levelNormal
+	levelVerbose
+)
+
+// logLevel is the threshold for our output. Errors are always logged.
+var logLevel = levelNormal
+
+// infof logs an event unless we are quiet, such as a completed transfer or
+// a warning.
+func infof(format string, args ...interface{}) {
+	if logLevel >= levelNormal {
+		log.Printf(format, args...)
+	}
+}
+
+// debugf logs detail only wanted when verbose, such as every chunk.
+func debugf(format string, args ...interface{}) {
+	if logLevel >= levelVerbose {
+		log.Printf(format, args...)
+	}
+}
+
+// noticef logs an event reported by the xfer package, which may be an error
+// or something we would log with infof.
+func noticef(format string, args ...interface{}) {
+	if strings.HasPrefix(format, "Error") {
+		log.Printf(format, args...)
+	} else {
+		infof(format, args...)
+	}
+}
+
+// statusLine coordinates our output on a terminal. Transient events such as
+// reconnects and retries share a single line that is updated in place, while
+// durable events, anything written through the log package, scroll as usual.
+// When not on a terminal every event is written as its own line.
+type statusLine struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tty  bool
+	line string
+}
+
+// status is where all of our output goes.
+var status = newStatusLine(os.Stderr)
+
+func newStatusLine(f *os.File) *statusLine {
+	return &statusLine{w: f, tty: isTerminal(f)}
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// statusf reports a transient event, such as a retry or reconnect, which
+// is kept like any other when verbose.
+func statusf(format string, args ...interface{}) {
+	if logLevel >= levelVerbose {
+		log.Printf(format, args...)
+		return
+	}
+	status.update(format, args...)
+}
+
+// update replaces the status line with a transient message, unless quiet.
+func (sl *statusLine) update(format string, args ...interface{}) {
+	if logLevel == levelQuiet {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	msg := fmt.Sprintf(format, args...)
+	if !sl.tty {
+		fmt.Fprintln(sl.w, msg)
+		return
+	}
+	sl.line = msg
+	fmt.Fprintf(sl.w, "\r\033[K%s", msg)
+}
+
+// Write writes a durable event, keeping the status line below it.
+// This allows the log package to use us for its output.
+func (sl *statusLine) Write(p []byte) (int, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if !sl.tty || sl.line == "" {
+		return sl.w.Write(p)
+	}
+	fmt.Fprint(sl.w, "\r\033[K")
+	n, err := sl.w.Write(p)
+	fmt.Fprint(sl.w, sl.line)
+	return n, err
+}
+
+// clear removes the status line, usually once a transfer has finished.
+func (sl *statusLine) clear() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.tty && sl.line != "" {
+		fmt.Fprint(sl.w, "\r\033[K")
+	}
+	sl.line = ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// How getFile reports chunk timing.
+const (
+	timingText = "text"
+	timingJSON = "json"
+)
+
+// A chunk that took this many times longer than the median to arrive is
+// reported as a stall, as long as it also took at least minStall.
+const (
+	stallFactor = 10
+	minStall    = 10 * time.Millisecond
+	// The most stalls we report, longest first.
+	maxStalls = 10
+)
+
+// chunkTimer records how long each chunk took to arrive after the previous one.
+type chunkTimer struct {
+	last  time.Time
+	times []chunkTime
+}
+
+type chunkTime struct {
+	seq uint64
+	d   time.Duration
+}
+
+// add records the arrival of the chunk with the stream sequence.
+// The first chunk only starts the clock.
+func (ct *chunkTimer) add(seq uint64) {
+	now := time.Now()
+	if !ct.last.IsZero() {
+		ct.times = append(ct.times, chunkTime{seq, now.Sub(ct.last)})
+	}
+	ct.last = now
+}
+
+// timingStats summarizes the chunk inter-arrival times, in milliseconds.
+type timingStats struct {
+	Chunks int          `json:"chunks"`
+	Min    float64      `json:"min_ms"`
+	Mean   float64      `json:"mean_ms"`
+	P50    float64      `json:"p50_ms"`
+	P99    float64      `json:"p99_ms"`
+	Max    float64      `json:"max_ms"`
+	Stalls []stallStats `json:"stalls,omitempty"`
+}
+
+type stallStats struct {
+	Seq uint64  `json:"seq"`
+	D   float64 `json:"ms"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (ct *chunkTimer) stats() *timingStats {
+	ts := &timingStats{Chunks: len(ct.times)}
+	if len(ct.times) == 0 {
+		return ts
+	}
+	sorted := make([]chunkTime, len(ct.times))
+	copy(sorted, ct.times)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].d < sorted[j].d })
+	var sum time.Duration
+	for _, t := range sorted {
+		sum += t.d
+	}
+	p50 := sorted[len(sorted)/2].d
+	ts.Min = ms(sorted[0].d)
+	ts.Mean = ms(sum / time.Duration(len(sorted)))
+	ts.P50 = ms(p50)
+	ts.P99 = ms(sorted[len(sorted)*99/100].d)
+	ts.Max = ms(sorted[len(sorted)-1].d)
+	for i := len(sorted) - 1; i >= 0 && len(ts.Stalls) < maxStalls; i-- {
+		if d := sorted[i].d; d < minStall || d < stallFactor*p50 {
+			break
+		}
+		ts.Stalls = append(ts.Stalls, stallStats{sorted[i].seq, ms(sorted[i].d)})
+	}
+	return ts
+}
+
+// report prints the statistics, as text to our log or as JSON to stdout.
+func (ct *chunkTimer) report(format string) error {
+	ts := ct.stats()
+	if format == timingJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(ts); err != nil {
+			return fmt.Errorf("error writing chunk timing: %v", err)
+		}
+		return nil
+	}
+	log.Printf("Chunk inter-arrival times for %d chunks: min %.3fms, mean %.3fms, p50 %.3fms, p99 %.3fms, max %.3fms",
+		ts.Chunks, ts.Min, ts.Mean, ts.P50, ts.P99, ts.Max)
+	for _, s := range ts.Stalls {
+		log.Printf("Stalled %.3fms before chunk at sequence %d", s.D, s.Seq)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/derekcollison/njs-xfer/xfer"
+	"github.com/nats-io/nats.go"
+)
+
+// checkpointInterval is how many chunks verifyStream hashes between checkpoints.
+const checkpointInterval = 1024
+
+// verifyCheckpoint records how far verifyStream got, so an interrupted
+// verification can resume where it left off instead of starting over.
+type verifyCheckpoint struct {
+	Stream  string    `json:"stream"`
+	Created time.Time `json:"created"`
+	// Seq is the last chunk hashed, and Size the bytes hashed up to it.
+	Seq  uint64 `json:"seq"`
+	Size int64  `json:"size"`
+	// State is the marshaled state of the running hash.
+	State []byte `json:"state"`
+}
+
+// loadCheckpoint returns the checkpoint in the file, or nil if there is none.
+func loadCheckpoint(file string) (*verifyCheckpoint, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cp verifyCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %q: %v", file, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint, replacing the file atomically so an
+// interruption never leaves a partial checkpoint behind.
+func (cp *verifyCheckpoint) save(file string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// verifyStream checks a stored transfer against its metadata by hashing all
+// of its chunks, without retrieving the file. With a checkpoint file the
+// progress is saved periodically, and a later run resumes from it. When strict,
+// the metadata must be complete, see checkStrictMeta.
+func verifyStream(nc *nats.Conn, name, checkpoint string, strict bool) error {
+	js := newJetStream(nc)
+
+	stream, err := resolveStream(js, name)
+	if err != nil {
+		return fmt.Errorf("error resolving %q: %v", name, err)
+	}
+	si, err := xfer.LookupStream(js, stream)
+	if err == xfer.ErrStreamNotFound {
+		return fmt.Errorf("%w: %s", xfer.ErrStreamNotFound, stream)
+	} else if err != nil {
+		return fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	tm, err := xfer.LookupMeta(js, si)
+	if err != nil {
+		return fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+	}
+	if tm == nil {
+		return fmt.Errorf("stream %q has no transfer metadata to verify against", stream)
+	}
+	if strict {
+		if err := checkStrictMeta(stream, tm); err != nil {
+			return err
+		}
+	}
+	if tm.Ref != "" {
+		if si, tm, err = xfer.LookupRef(js, tm); err != nil {
+			return fmt.Errorf("error following %q to stream %q: %v", stream, tm.Ref, err)
+		}
+		stream = si.Config.Name
+	}
+	// We hash the chunks in stream order, which is not the file's.
+	if xfer.IsParallel(si) {
+		return fmt.Errorf("stream %q holds a parallel transfer, use get to verify it", stream)
+	}
+
+	// The chunks are everything before the trailer.
+	h := sha256.New()
+	cp := &verifyCheckpoint{Stream: stream, Created: si.Created, Seq: si.State.FirstSeq - 1}
+	if checkpoint != "" {
+		saved, err := loadCheckpoint(checkpoint)
+		if err != nil {
+			return fmt.Errorf("error loading checkpoint: %v", err)
+		}
+		if saved != nil && (saved.Stream != stream || !saved.Created.Equal(si.Created)) {
+			infof("Checkpoint %q is for a different stream, starting over", checkpoint)
+		} else if saved != nil {
+			if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.State); err != nil {
+				return fmt.Errorf("error restoring checkpoint: %v", err)
+			}
+			cp = saved
+			infof("Resuming verification of %q after sequence %d", stream, cp.Seq)
+		}
+	}
+	save := func() error {
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("error saving checkpoint: %v", err)
+		}
+		cp.State = state
+		if err := cp.save(checkpoint); err != nil {
+			return fmt.Errorf("error saving checkpoint: %v", err)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	last := si.State.LastSeq - 1
+	if cp.Seq < last {
+		sub, err := js.SubscribeSync(
+			si.Config.Subjects[0],
+			nats.AckNone(),
+			nats.StartSequence(cp.Seq+1),
+			nats.EnableFlowControl(),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating consumer: %v", err)
+		}
+		defer sub.Unsubscribe()
+
+		for n := 1; cp.Seq < last; n++ {
+			m, err := sub.NextMsg(5 * time.Second)
+			if err != nil {
+				return fmt.Errorf("error scanning stream %q: %v", stream, err)
+			}
+			meta, err := m.Metadata()
+			if err != nil {
+				return err
+			}
+			if seq := meta.Sequence.Stream; seq != cp.Seq+1 {
+				return &xfer.IntegrityError{Msg: fmt.Sprintf("missing chunk in stream %q, expected sequence %d but got %d", stream, cp.Seq+1, seq)}
+			}
+			cp.Seq++
+			// Skip trailers superseded by recover.
+			if m.Header.Get(xfer.HeaderMeta) != "" {
+				continue
+			}
+			data, err := decrypter.ChunkData(m.Header, m.Data)
+			if err != nil {
+				return fmt.Errorf("error reading chunk %d of %q: %w", cp.Seq, stream, err)
+			}
+			h.Write(data)
+			cp.Size += int64(len(data))
+			if checkpoint != "" && n%checkpointInterval == 0 {
+				if err := save(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if cp.Size != tm.Size {
+		return &xfer.IntegrityError{Msg: fmt.Sprintf("size mismatch for %q, expected %d bytes but got %d", stream, tm.Size, cp.Size)}
+	}
+	if hex.EncodeToString(h.Sum(nil)) != tm.Digest {
+		return &xfer.IntegrityError{Msg: fmt.Sprintf("checksum mismatch for %q, stored transfer is corrupt", stream)}
+	}
+	if checkpoint != "" {
+		os.Remove(checkpoint)
+	}
+	infof("Verified %v in %q in %v", friendlyBytes(int(cp.Size)), stream, time.Since(start))
+	return nil
+}
@@ -0,0 +1,69 @@
+package xfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Chunks are compressed individually, so each one can still be placed at its
+// offset in the file. Compressed chunks carry the HeaderCompression header,
+// which lets get handle them even before it has seen the trailer.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// hasExt reports whether the file name has one of the extensions.
+func hasExt(fileName string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// compressChunk returns a compressed copy of the chunk.
+func compressChunk(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ChunkData returns the contents of a chunk given its headers and data,
+// decompressing it if needed. Chunks of encrypted transfers need a Decrypter.
+func ChunkData(hdr http.Header, data []byte) ([]byte, error) {
+	return NewDecrypter("").ChunkData(hdr, data)
+}
+
+// decompressChunk returns the chunk's data, decompressing it if needed.
+func decompressChunk(hdr http.Header, data []byte) ([]byte, error) {
+	switch c := hdr.Get(HeaderCompression); c {
+	case "":
+		return data, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %v", err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %v", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+}
@@ -0,0 +1,208 @@
+package xfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Consumer modes for Get, see GetOptions.Mode.
+// With ConsumerFlow, the default, the server pushes chunks without waiting
+// for acks and flow control keeps it from overrunning us. With ConsumerPull
+// we fetch chunks in batches and ack each one once it is written, so no more
+// than GetOptions.MaxAckPending are ever outstanding.
+const (
+	ConsumerFlow = "flow"
+	ConsumerPull = "pull"
+)
+
+// DefaultMaxAckPending is the number of chunks a pull consumer has
+// outstanding unless GetOptions.MaxAckPending is set.
+const DefaultMaxAckPending = 64
+
+// chunkSource delivers the messages of a stream from a starting sequence,
+// whichever kind of consumer they come from.
+type chunkSource interface {
+	// next waits up to timeout for the next message, returning
+	// nats.ErrTimeout if none arrives, or the error of ctx once it is done.
+	next(ctx context.Context, timeout time.Duration) (*nats.Msg, error)
+	// done tells the consumer we are finished with m. It may be called from
+	// another go routine than next.
+	done(m *nats.Msg)
+	close()
+}
+
+// newChunkSource creates a consumer of subj in stream starting at seq, of
+// the kind opts.Mode asks for. Tests replace it to simulate missed chunks.
+var newChunkSource = openChunkSource
+
+func openChunkSource(js nats.JetStreamContext, stream, subj string, seq uint64, opts GetOptions) (chunkSource, error) {
+	if opts.Mode == ConsumerPull {
+		// A nil *pullSource would not be a nil chunkSource.
+		ps, err := newPullSource(js, stream, subj, seq, opts)
+		if err != nil {
+			return nil, err
+		}
+		return ps, nil
+	}
+	sopts := []nats.SubOpt{
+		nats.AckNone(),
+		nats.MaxDeliver(1),
+		nats.StartSequence(seq),
+		nats.EnableFlowControl(),
+	}
+	// This is mostly useful for reproducing timing sensitive scenarios.
+	if opts.ReplayOriginal {
+		sopts = append(sopts, nats.ReplayOriginal())
+	}
+	sub, err := js.SubscribeSync(subj, sopts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating consumer: %v", err)
+	}
+	debugConsumer(sub, opts.Debugf)
+	return flowSource{sub}, nil
+}
+
+// checkMode checks the consumer mode in opts.
+func checkMode(opts GetOptions) error {
+	switch opts.Mode {
+	case "", ConsumerFlow:
+		return nil
+	case ConsumerPull:
+		if opts.MaxAckPending < 0 {
+			return fmt.Errorf("invalid maximum of %d pending acks", opts.MaxAckPending)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown consumer mode %q, expected %q or %q", opts.Mode, ConsumerFlow, ConsumerPull)
+}
+
+// flowSource is a push consumer without acks, relying on flow control.
+type flowSource struct {
+	sub *nats.Subscription
+}
+
+func (fs flowSource) next(ctx context.Context, timeout time.Duration) (*nats.Msg, error) {
+	return nextMsg(ctx, fs.sub, timeout)
+}
+
+func (fs flowSource) done(m *nats.Msg) {}
+
+func (fs flowSource) close() {
+	fs.sub.Unsubscribe()
+}
+
+// pullSource is a pull consumer with explicit acks. It fetches as many
+// messages as may be pending at once and hands them out one at a time.
+// Messages are acked as they are written, which can be after we are
+// ready for the next batch, so we only fetch as many as have been acked.
+type pullSource struct {
+	sub     *nats.Subscription
+	batch   int
+	pending []*nats.Msg
+	debugf  func(format string, args ...interface{})
+	mu      sync.Mutex
+	unacked int
+	acked   chan struct{}
+}
+
+func newPullSource(js nats.JetStreamContext, stream, subj string, seq uint64, opts GetOptions) (*pullSource, error) {
+	batch := opts.MaxAckPending
+	if batch == 0 {
+		batch = DefaultMaxAckPending
+	}
+	sopts := []nats.SubOpt{
+		nats.BindStream(stream),
+		nats.AckExplicit(),
+		nats.MaxAckPending(batch),
+		nats.StartSequence(seq),
+	}
+	if opts.ReplayOriginal {
+		sopts = append(sopts, nats.ReplayOriginal())
+	}
+	// Pull consumers have to be durable, so we give ours a name of its own.
+	// It is deleted when we close it.
+	durable := "njs-xfer-" + strings.TrimPrefix(nats.NewInbox(), nats.InboxPrefix)
+	sub, err := js.PullSubscribe(subj, durable, sopts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating consumer: %v", err)
+	}
+	debugConsumer(sub, opts.Debugf)
+	return &pullSource{sub: sub, batch: batch, debugf: opts.Debugf, acked: make(chan struct{}, 1)}, nil
+}
+
+func (ps *pullSource) next(ctx context.Context, timeout time.Duration) (*nats.Msg, error) {
+	if len(ps.pending) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := ps.room(ctx, timeout)
+		if err != nil {
+			return nil, err
+		}
+		// The server gives up on the request when we do, so chunks are not
+		// delivered to a request nobody is waiting on.
+		msgs, err := ps.sub.Fetch(n, nats.MaxWait(timeout))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err != nil && len(msgs) == 0 {
+			if err == nats.ErrTimeout || strings.Contains(err.Error(), "Request Timeout") {
+				return nil, nats.ErrTimeout
+			}
+			return nil, err
+		}
+		logf(ps.debugf, "Fetched %d chunks", len(msgs))
+		ps.mu.Lock()
+		ps.unacked += len(msgs)
+		ps.mu.Unlock()
+		ps.pending = msgs
+	}
+	m := ps.pending[0]
+	ps.pending = ps.pending[1:]
+	return m, nil
+}
+
+// room waits up to timeout for fewer than a batch of messages to be unacked,
+// returning how many more we may fetch.
+func (ps *pullSource) room(ctx context.Context, timeout time.Duration) (int, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		ps.mu.Lock()
+		n := ps.batch - ps.unacked
+		ps.mu.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+		select {
+		case <-ps.acked:
+		case <-t.C:
+			return 0, nats.ErrTimeout
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (ps *pullSource) done(m *nats.Msg) {
+	if err := m.Ack(); err != nil {
+		logf(ps.debugf, "Error acknowledging chunk: %v", err)
+	}
+	ps.mu.Lock()
+	ps.unacked--
+	ps.mu.Unlock()
+	select {
+	case ps.acked <- struct{}{}:
+	default:
+	}
+}
+
+func (ps *pullSource) close() {
+	// This also deletes the durable consumer.
+	ps.sub.Unsubscribe()
+}
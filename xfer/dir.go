@@ -0,0 +1,539 @@
+package xfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// A directory is transferred as a single stream. Each directory and file in
+// the tree has an entry message, with its path relative to the top, mode,
+// size and modification time, and each file's chunks follow its entry. Chunk
+// indexes run across the whole transfer, and the trailer's size and digest
+// cover the contents of all of the files in order. With PutOptions.Dedup a
+// file with the same contents as an earlier one has no chunks, and its
+// entry refers to the earlier file instead, so the trailer only covers the
+// files that were sent.
+
+// dirEntry is a directory or file found by walkDir.
+type dirEntry struct {
+	// Slash separated path relative to the top of the tree.
+	path string
+	// Where to read it from, which may be the target of a symbolic link.
+	src string
+	fi  fs.FileInfo
+}
+
+// walkDir returns the entries below root in lexical order, skipping anything
+// that is not a directory or regular file. Symbolic links are skipped unless
+// we are following them, and a link back into a directory we are already
+// walking is an error.
+func walkDir(root string, followSymlinks bool, logf func(format string, args ...interface{})) ([]dirEntry, error) {
+	var entries []dirEntry
+	var walk func(src, prefix string, active map[string]bool) error
+	walk = func(src, prefix string, active map[string]bool) error {
+		real, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return err
+		}
+		if active[real] {
+			return fmt.Errorf("symbolic link loop at %q", src)
+		}
+		active[real] = true
+		defer delete(active, real)
+
+		// WalkDir does not descend into a link, so we walk its target.
+		return filepath.WalkDir(real, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == real {
+				return nil
+			}
+			rel, err := filepath.Rel(real, p)
+			if err != nil {
+				return err
+			}
+			rel = path.Join(prefix, filepath.ToSlash(rel))
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				if !followSymlinks {
+					logf("Skipping symbolic link %q", p)
+					return nil
+				}
+				if fi, err = os.Stat(p); err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					entries = append(entries, dirEntry{rel, p, fi})
+					return walk(p, rel, active)
+				}
+			}
+			switch {
+			case fi.IsDir(), fi.Mode().IsRegular():
+				entries = append(entries, dirEntry{rel, p, fi})
+			default:
+				logf("Skipping %q, not a regular file", p)
+			}
+			return nil
+		})
+	}
+	if err := walk(root, "", make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// entryMsg returns the entry message for a directory or file.
+func entryMsg(subj string, de *dirEntry) *nats.Msg {
+	m := nats.NewMsg(subj)
+	m.Header.Set(HeaderEntry, EntryFile)
+	if de.fi.IsDir() {
+		m.Header.Set(HeaderEntry, EntryDir)
+	}
+	m.Header.Set(HeaderPath, de.path)
+	m.Header.Set(HeaderMode, strconv.FormatUint(uint64(de.fi.Mode().Perm()), 8))
+	m.Header.Set(HeaderModTime, de.fi.ModTime().UTC().Format(time.RFC3339Nano))
+	if !de.fi.IsDir() {
+		m.Header.Set(HeaderSize, strconv.FormatInt(de.fi.Size(), 10))
+	}
+	return m
+}
+
+// PutDir stores the tree below root in a new stream as a single transfer,
+// named after root unless opts.Name is set. Following is not supported.
+// Like Put it stops once ctx is done.
+func PutDir(ctx context.Context, js nats.JetStreamContext, root string, opts PutOptions) (*Result, error) {
+	if opts.Follow != nil || opts.Parallel > 1 {
+		return nil, fmt.Errorf("%q is a directory, which can not be followed or put in parallel", root)
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(root)
+	}
+	entries, err := walkDir(root, opts.FollowSymlinks, func(format string, args ...interface{}) {
+		logf(opts.Logf, format, args...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %q: %v", root, err)
+	}
+	p, err := newPutter(ctx, js, &opts)
+	if err != nil {
+		return nil, err
+	}
+	// With dedup we find the duplicates up front, so we know how much we
+	// will send.
+	digests := make([]string, len(entries))
+	same := make([]string, len(entries))
+	if opts.Dedup {
+		first := make(map[string]string)
+		for i, de := range entries {
+			if de.fi.IsDir() || de.fi.Size() == 0 {
+				continue
+			}
+			if digests[i], err = fileDigest(de.src); err != nil {
+				return nil, fmt.Errorf("error reading %q: %v", de.src, err)
+			}
+			if earlier, ok := first[digests[i]]; ok {
+				same[i] = earlier
+			} else {
+				first[digests[i]] = de.path
+			}
+		}
+	}
+	var size int64
+	for i, de := range entries {
+		if !de.fi.IsDir() && same[i] == "" {
+			size += de.fi.Size()
+		}
+	}
+	p.pr = newProgressReporter(opts.Progress, 0, size)
+	h := sha256.New()
+	for i := range entries {
+		de := &entries[i]
+		m := entryMsg(p.subj, de)
+		if same[i] != "" {
+			m.Header.Set(HeaderSame, same[i])
+		}
+		if err := p.publish(m); err != nil {
+			return nil, err
+		}
+		if de.fi.IsDir() {
+			continue
+		}
+		if same[i] != "" {
+			logf(opts.Debugf, "Stored %q as a duplicate of %q", de.path, same[i])
+			p.res.Files++
+			continue
+		}
+		fd, err := os.Open(de.src)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %q: %v", de.src, err)
+		}
+		// Hash the contents as they are read so the digest covers the whole
+		// tree, and the file's own digest shows whether it is still what its
+		// duplicates refer to.
+		fh := sha256.New()
+		cw := &countWriter{w: io.MultiWriter(h, fh)}
+		_, err = p.sendFile(io.TeeReader(fd, cw), de.src, -1)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+		if cw.n != de.fi.Size() {
+			return nil, fmt.Errorf("%q changed size during the transfer", de.src)
+		}
+		if digests[i] != "" && hex.EncodeToString(fh.Sum(nil)) != digests[i] {
+			return nil, fmt.Errorf("%q changed during the transfer", de.src)
+		}
+		p.res.Files++
+	}
+	tm := &Meta{
+		Name:    opts.Name,
+		Digest:  hex.EncodeToString(h.Sum(nil)),
+		ModTime: fi.ModTime(),
+		Mode:    fi.Mode().Perm(),
+		Dir:     true,
+	}
+	return p.finish(tm)
+}
+
+// fileDigest returns the hex encoded SHA-256 digest of the file's contents.
+func fileDigest(name string) (string, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile copies src to dst, which must not exist, creating it with mode
+// and returning how many bytes were copied.
+func copyFile(src, dst string, mode os.FileMode) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// localPath converts a path from an entry to one below dest, refusing
+// anything that would escape it.
+func localPath(dest, p string) (string, error) {
+	clean := path.Clean(p)
+	if p == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return filepath.Join(dest, filepath.FromSlash(clean)), nil
+}
+
+// GetDir retrieves the directory transfer in opts.Stream, recreating the tree
+// as dest, which must not exist. Following, windows and resuming are not
+// supported. Like Get it stops once ctx is done, leaving dest as it is.
+func GetDir(ctx context.Context, js nats.JetStreamContext, dest string, opts GetOptions) (*Result, error) {
+	si, tm, err := lookupTransfer(js, opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	stream := si.Config.Name
+	if tm == nil || !tm.Dir {
+		return nil, fmt.Errorf("stream %q does not hold a directory", stream)
+	}
+	if opts.Follow || opts.SinceSeq > 0 || opts.UntilSeq > 0 || opts.Resume != nil {
+		return nil, fmt.Errorf("stream %q holds a directory, which can not be followed, windowed or resumed", stream)
+	}
+	if tm.Encryption != "" && opts.Passphrase == "" {
+		return nil, fmt.Errorf("stream %q: %w", stream, ErrNoPassphrase)
+	}
+	dec := NewDecrypter(opts.Passphrase)
+	lim := newLimiter(opts.Rate)
+	checkExpiry(si, func(format string, args ...interface{}) {
+		logf(opts.Logf, format, args...)
+	})
+	verify := opts.Verify
+	if verify == "" {
+		verify = VerifyFull
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("destination directory %w: %s", ErrExists, dest)
+	}
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %v", err)
+	}
+
+	createSub := func(startSeq uint64) (*nats.Subscription, error) {
+		sub, err := js.SubscribeSync(si.Config.Subjects[0],
+			nats.AckNone(),
+			nats.MaxDeliver(1),
+			nats.StartSequence(startSeq),
+			nats.EnableFlowControl(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error creating consumer: %v", err)
+		}
+		debugConsumer(sub, opts.Debugf)
+		return sub, nil
+	}
+	sub, err := createSub(si.State.FirstSeq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { sub.Unsubscribe() }()
+
+	// The file we are writing, and how much of it we expect.
+	var fd *os.File
+	var fpath string
+	var fsize, fwritten int64
+	var fmtime time.Time
+	var fmode os.FileMode
+	// The files written so far, which duplicates may refer to.
+	files := make(map[string]bool)
+	defer func() {
+		if fd != nil {
+			fd.Close()
+		}
+	}()
+	closeFile := func() error {
+		if fd == nil {
+			return nil
+		}
+		if verify != VerifyNone && fwritten != fsize {
+			return integrityErrorf("size mismatch for %q, expected %d bytes but got %d", fpath, fsize, fwritten)
+		}
+		if opts.Sync {
+			if err := fd.Sync(); err != nil {
+				return fmt.Errorf("error syncing file: %v", err)
+			}
+		}
+		err := fd.Close()
+		fd = nil
+		if err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+		// Files are created with their mode, less the umask, so set it again.
+		if err := RestoreMode(fpath, fmode); err != nil {
+			logf(opts.Logf, "Error setting mode of %q: %v", fpath, err)
+		}
+		if err := os.Chtimes(fpath, fmtime, fmtime); err != nil {
+			logf(opts.Logf, "Error setting modification time of %q: %v", fpath, err)
+		}
+		return nil
+	}
+	// Directory modes and times are set at the end, since we need to write
+	// into them and doing so changes their times.
+	// Older transfers did not record the mode of the directory itself.
+	root := os.FileMode(0755)
+	if tm.Mode != 0 {
+		root = tm.Mode
+	}
+	dirs := []dirAttrs{{dest, root, tm.ModTime}}
+	pr := newProgressReporter(opts.Progress, 0, tm.Size)
+
+	var dv *digestVerifier
+	if verify == VerifyFull {
+		dv = newDigestVerifier()
+	}
+	res := &Result{Stream: stream, Meta: tm}
+	eseq := si.State.FirstSeq
+	done := false
+	var rm recvMeter
+	for {
+		start := time.Now()
+		m, err := nextMsg(ctx, sub, recvTimeout(opts, 5*time.Second))
+		if err == nats.ErrSlowConsumer && !opts.NoRecover {
+			continue
+		} else if err != nil && ctx.Err() != nil {
+			return nil, err
+		} else if err != nil {
+			return nil, integrityErrorf("transfer of %q incomplete: %v", stream, err)
+		}
+		rm.waited(time.Since(start))
+		rm.add(len(m.Data))
+		meta, err := m.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		if eseq != meta.Sequence.Stream {
+			if opts.NoRecover {
+				return nil, integrityErrorf("missed chunk sequence in %q, expected %d but got %d", stream, eseq, meta.Sequence.Stream)
+			}
+			if err := chunksGone(js, stream, eseq); err != nil {
+				return nil, err
+			}
+			res.Gaps++
+			if opts.MaxGapRetries > 0 && res.Gaps > opts.MaxGapRetries {
+				return nil, integrityErrorf("giving up on %q after recovering from %d gaps, last expected %d but got %d",
+					stream, opts.MaxGapRetries, eseq, meta.Sequence.Stream)
+			}
+			logf(opts.Statusf, "Missed chunk sequence, expected %d but got %d, resetting", eseq, meta.Sequence.Stream)
+			sub.Unsubscribe()
+			if sub, err = createSub(eseq); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		eseq++
+
+		switch {
+		case m.Header.Get(HeaderMeta) != "":
+			// Trailers before the last message were superseded by recover.
+			done = meta.Sequence.Stream >= si.State.LastSeq
+		case m.Header.Get(HeaderEntry) != "":
+			if err := closeFile(); err != nil {
+				return nil, err
+			}
+			p, err := localPath(dest, m.Header.Get(HeaderPath))
+			if err != nil {
+				return nil, fmt.Errorf("error in entry at sequence %d of %q: %v", meta.Sequence.Stream, stream, err)
+			}
+			mode, err := strconv.ParseUint(m.Header.Get(HeaderMode), 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode in entry at sequence %d of %q", meta.Sequence.Stream, stream)
+			}
+			mtime, _ := time.Parse(time.RFC3339Nano, m.Header.Get(HeaderModTime))
+			if m.Header.Get(HeaderEntry) == EntryDir {
+				if err := os.Mkdir(p, 0700); err != nil {
+					return nil, fmt.Errorf("error creating directory: %v", err)
+				}
+				dirs = append(dirs, dirAttrs{p, os.FileMode(mode), mtime})
+				continue
+			}
+			size, _ := strconv.ParseInt(m.Header.Get(HeaderSize), 10, 64)
+			if same := m.Header.Get(HeaderSame); same != "" {
+				src, err := localPath(dest, same)
+				if err != nil || !files[src] {
+					return nil, integrityErrorf("entry at sequence %d of %q refers to %q, which is not an earlier file", meta.Sequence.Stream, stream, same)
+				}
+				n, err := copyFile(src, p, os.FileMode(mode))
+				if err != nil {
+					return nil, fmt.Errorf("error copying %q to %q: %v", src, p, err)
+				}
+				if verify != VerifyNone && n != size {
+					return nil, integrityErrorf("size mismatch for %q, expected %d bytes but got %d", p, size, n)
+				}
+				if err := RestoreMode(p, os.FileMode(mode)); err != nil {
+					logf(opts.Logf, "Error setting mode of %q: %v", p, err)
+				}
+				if err := os.Chtimes(p, mtime, mtime); err != nil {
+					logf(opts.Logf, "Error setting modification time of %q: %v", p, err)
+				}
+				files[p] = true
+				res.Files++
+				continue
+			}
+			if fd, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(mode)); err != nil {
+				return nil, fmt.Errorf("error creating file: %v", err)
+			}
+			fsize, fpath, fwritten, fmtime, fmode = size, p, 0, mtime, os.FileMode(mode)
+			files[p] = true
+			res.Files++
+		default:
+			if fd == nil {
+				return nil, integrityErrorf("chunk at sequence %d of %q does not follow a file entry", meta.Sequence.Stream, stream)
+			}
+			if err := lim.wait(ctx, len(m.Data)); err != nil {
+				return nil, err
+			}
+			data, err := dec.ChunkData(m.Header, m.Data)
+			if err != nil {
+				return nil, integrityErrorf("error reading chunk at sequence %d of %q: %v", meta.Sequence.Stream, stream, err)
+			}
+			if err := writeFull(fd, data); err != nil {
+				return nil, err
+			}
+			logf(opts.Debugf, "Received chunk of %q at sequence %d, %d bytes", fpath, meta.Sequence.Stream, len(data))
+			fwritten += int64(len(data))
+			res.Bytes += int64(len(data))
+			res.Chunks++
+			pr.add(len(data))
+			if dv != nil {
+				dv.add(data)
+			}
+		}
+		if done {
+			break
+		}
+	}
+	if err := closeFile(); err != nil {
+		return nil, err
+	}
+	if verify != VerifyNone && res.Bytes != tm.Size {
+		return nil, integrityErrorf("size mismatch for %q, expected %d bytes but got %d", stream, tm.Size, res.Bytes)
+	}
+	if dv != nil {
+		if sum := dv.sum(); sum != tm.Digest {
+			return nil, integrityErrorf("checksum mismatch for %q, expected SHA-256 %s but got %s, retrieved directory is corrupt", stream, tm.Digest, sum)
+		}
+		logf(opts.Debugf, "Verified %q while writing it, hashing took %v", stream, dv.hashed)
+	}
+	rm.report(res)
+	pr.finish()
+	restoreDirs(dirs, opts.Logf)
+	return res, nil
+}
+
+// dirAttrs are the mode and time to give a directory we created.
+type dirAttrs struct {
+	path  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// restoreDirs gives the directories their modes and times, innermost first,
+// once everything has been written into them.
+func restoreDirs(dirs []dirAttrs, f func(format string, args ...interface{})) {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		da := dirs[i]
+		if err := RestoreMode(da.path, da.mode); err != nil {
+			logf(f, "Error setting mode of %q: %v", da.path, err)
+		}
+		if !da.mtime.IsZero() {
+			if err := os.Chtimes(da.path, da.mtime, da.mtime); err != nil {
+				logf(f, "Error setting modification time of %q: %v", da.path, err)
+			}
+		}
+	}
+}
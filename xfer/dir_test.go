@@ -0,0 +1,77 @@
+package xfer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutDirDedup(t *testing.T) {
+	_, js := runServer(t)
+	_, shared := randomFile(t, "shared", 3000)
+	_, other := randomFile(t, "other", 2500)
+	tree := map[string][]byte{
+		"a/index.js":           shared,
+		"b/index.js":           shared,
+		"b/node_modules/c.js":  shared,
+		"b/node_modules/d.js":  other,
+		"empty":                nil,
+		"b/empty":              nil,
+		"z/shared_but_renamed": shared,
+	}
+	root := t.TempDir()
+	for name, data := range tree {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dedup := range []bool{false, true} {
+		stream := "plain"
+		if dedup {
+			stream = "dedup"
+		}
+		res, err := PutDir(context.Background(), js, root, PutOptions{Stream: stream, ChunkSize: 1024, Dedup: dedup})
+		if err != nil {
+			t.Fatalf("Error putting directory: %v", err)
+		}
+		// Each of the contents is sent once.
+		want := int64(4*len(shared) + len(other))
+		if dedup {
+			want = int64(len(shared) + len(other))
+		}
+		if res.Bytes != want || res.Files != len(tree) {
+			t.Fatalf("Put %d bytes in %d files, expected %d in %d", res.Bytes, res.Files, want, len(tree))
+		}
+
+		dest := filepath.Join(t.TempDir(), "out")
+		gres, err := GetDir(context.Background(), js, dest, GetOptions{Stream: stream})
+		if err != nil {
+			t.Fatalf("Error getting directory: %v", err)
+		}
+		if gres.Files != len(tree) {
+			t.Fatalf("Retrieved %d files, expected %d", gres.Files, len(tree))
+		}
+		for name, data := range tree {
+			path := filepath.Join(dest, filepath.FromSlash(name))
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Error reading %q: %v", name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%q holds %d bytes that differ from the %d put", name, len(got), len(data))
+			}
+			fi, err := os.Stat(path)
+			if err != nil || fi.Mode().Perm() != 0640 {
+				t.Fatalf("%q has mode %v, expected %v", name, fi.Mode().Perm(), os.FileMode(0640))
+			}
+		}
+	}
+}
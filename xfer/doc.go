@@ -0,0 +1,9 @@
+// Package xfer stores files in NATS JetStream streams and retrieves them.
+//
+// A file is split into chunks, each published as a message to a stream of its
+// own, followed by a trailer message whose headers carry the metadata: the
+// file's name, size, modification time and SHA-256 digest. Put and PutDir
+// store a file or a directory tree, and Get and GetDir retrieve them,
+// recovering from missed chunks and verifying what they receive. Errors are
+// returned, never logged, so the caller decides how to report them.
+package xfer
@@ -0,0 +1,117 @@
+package xfer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Chunks can be encrypted with a key derived from a passphrase, after any
+// compression. Each transfer has a random salt for its key, and each chunk a
+// random nonce stored in front of its sealed contents. Encrypted chunks carry
+// the HeaderEncryption and HeaderSalt headers, which are also recorded in the
+// metadata, so get can decrypt them even before it has seen the trailer.
+const EncryptionAESGCM = "aes-256-gcm"
+
+// Parameters for deriving keys from passphrases with scrypt.
+const (
+	scryptN  = 1 << 15
+	scryptR  = 8
+	scryptP  = 1
+	keySize  = 32
+	saltSize = 16
+)
+
+// ErrNoPassphrase is returned for an encrypted transfer when no passphrase was given.
+var ErrNoPassphrase = errors.New("transfer is encrypted, a passphrase is needed")
+
+// newSalt returns a random hex encoded salt for a transfer's key.
+func newSalt() (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// newCipher derives the key for a transfer from the passphrase and salt.
+func newCipher(passphrase, salt string) (cipher.AEAD, error) {
+	bs, err := hex.DecodeString(salt)
+	if err != nil || len(bs) == 0 {
+		return nil, fmt.Errorf("invalid salt %q", salt)
+	}
+	key, err := scrypt.Key([]byte(passphrase), bs, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptChunk returns the sealed chunk preceded by its nonce.
+func encryptChunk(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypter returns the contents of chunks like ChunkData, first decrypting
+// those of encrypted transfers with its passphrase. The key is only derived
+// again when the salt changes.
+type Decrypter struct {
+	passphrase string
+	salt       string
+	aead       cipher.AEAD
+}
+
+// NewDecrypter returns a Decrypter for the passphrase, which may be empty
+// if no transfers are expected to be encrypted.
+func NewDecrypter(passphrase string) *Decrypter {
+	return &Decrypter{passphrase: passphrase}
+}
+
+// ChunkData returns the contents of a chunk given its headers and data,
+// decrypting and decompressing it if needed. A chunk that fails to decrypt,
+// because the passphrase is wrong or the chunk was altered, is an integrity
+// error, as is one that does not match its checksum.
+func (d *Decrypter) ChunkData(hdr http.Header, data []byte) ([]byte, error) {
+	if err := checkChunkCRC(hdr, data); err != nil {
+		return nil, err
+	}
+	switch e := hdr.Get(HeaderEncryption); e {
+	case "":
+	case EncryptionAESGCM:
+		if d.passphrase == "" {
+			return nil, ErrNoPassphrase
+		}
+		if salt := hdr.Get(HeaderSalt); d.aead == nil || salt != d.salt {
+			aead, err := newCipher(d.passphrase, salt)
+			if err != nil {
+				return nil, fmt.Errorf("error deriving key: %v", err)
+			}
+			d.aead, d.salt = aead, salt
+		}
+		ns := d.aead.NonceSize()
+		if len(data) < ns {
+			return nil, integrityErrorf("encrypted chunk is too short")
+		}
+		var err error
+		if data, err = d.aead.Open(nil, data[:ns], data[ns:], nil); err != nil {
+			return nil, integrityErrorf("error decrypting chunk, the passphrase is wrong or the chunk was altered")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption %q", e)
+	}
+	return decompressChunk(hdr, data)
+}
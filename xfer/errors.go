@@ -0,0 +1,36 @@
+package xfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStreamNotFound is returned from LookupStream when the stream does not
+// exist, and wrapped by other errors for a missing stream.
+var ErrStreamNotFound = errors.New("stream not found")
+
+// ErrExists is wrapped by errors for a stream or destination that already
+// exists and would be overwritten.
+var ErrExists = errors.New("already exists")
+
+// ErrIntegrity is matched by errors for a transfer that fails an integrity
+// check, such as missed chunks or a digest that does not match.
+var ErrIntegrity = errors.New("integrity check failed")
+
+// IntegrityError describes an integrity failure. It matches ErrIntegrity
+// with errors.Is.
+type IntegrityError struct {
+	Msg string
+}
+
+func (e *IntegrityError) Error() string {
+	return e.Msg
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrIntegrity
+}
+
+func integrityErrorf(format string, args ...interface{}) error {
+	return &IntegrityError{fmt.Sprintf(format, args...)}
+}
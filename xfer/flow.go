@@ -0,0 +1,155 @@
+package xfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Limits for the publish window, in chunks. Without adaptive flow control
+// the window stays at startFlowWindow. With it the window starts at
+// startAdaptiveWindow and stays between minFlowWindow and maxFlowWindow.
+const (
+	minFlowWindow       = 1
+	startFlowWindow     = 8
+	startAdaptiveWindow = 2
+	maxFlowWindow       = 256
+)
+
+// A chunk whose acknowledgement takes longer than flowStallThreshold to arrive,
+// once it is the oldest outstanding, means the server is not keeping up.
+// One that takes longer than flowAckTimeout means it is not responding at all.
+const (
+	flowStallThreshold = 100 * time.Millisecond
+	flowAckTimeout     = 10 * time.Second
+)
+
+// flowController keeps a sliding window of chunks outstanding, checking each
+// acknowledgement for errors. When adaptive it adapts the window to what the
+// server can handle, similar to TCP congestion control. Starting small, the
+// window doubles for every window's worth of timely acknowledgements until
+// we first stall waiting on one or a chunk has to be retried. From then on
+// it grows by one chunk instead, and is halved whenever that happens again.
+type flowController struct {
+	ctx      context.Context
+	adaptive bool
+	window   int
+	acked    int
+	// ramping is set until the window is first reduced.
+	ramping bool
+	pafs    []nats.PubAckFuture
+	statusf func(format string, args ...interface{})
+	// lastSeq is the stream sequence of the last chunk acknowledged, and dups
+	// how many the server discarded as duplicates.
+	lastSeq uint64
+	dups    int
+	// retry, if set, is called when a chunk fails and can recover from it.
+	retry func(paf nats.PubAckFuture, err error) error
+}
+
+func newFlowController(ctx context.Context, adaptive bool, statusf func(format string, args ...interface{})) *flowController {
+	fc := &flowController{ctx: ctx, adaptive: adaptive, window: startFlowWindow, statusf: statusf}
+	if adaptive {
+		fc.window, fc.ramping = startAdaptiveWindow, true
+	}
+	return fc
+}
+
+// wait blocks until there is room in the window for another chunk.
+func (fc *flowController) wait() error {
+	for len(fc.pafs) >= fc.window {
+		start := time.Now()
+		if err := fc.ack(flowAckTimeout); err != nil {
+			return err
+		}
+		if !fc.adaptive {
+			continue
+		}
+		if time.Since(start) > flowStallThreshold {
+			fc.shrink("Server is not keeping up")
+		} else if fc.acked++; fc.acked >= fc.window {
+			fc.grow()
+		}
+	}
+	return nil
+}
+
+// ack waits for the oldest outstanding chunk to be acknowledged, or for our
+// context to be done.
+func (fc *flowController) ack(timeout time.Duration) error {
+	paf := fc.pafs[0]
+	fc.pafs = fc.pafs[1:]
+	var err error
+	select {
+	case pa := <-paf.Ok():
+		fc.stored(pa)
+		return nil
+	case err = <-paf.Err():
+	case <-time.After(timeout):
+		err = nats.ErrTimeout
+	case <-fc.ctx.Done():
+		return fc.ctx.Err()
+	}
+	if fc.retry != nil && isTransient(err) {
+		if fc.adaptive {
+			fc.shrink("Chunk failed")
+		}
+		return fc.retry(paf, err)
+	}
+	if err == nats.ErrTimeout {
+		return errors.New("timed out waiting for the server to acknowledge a chunk")
+	}
+	return fmt.Errorf("error sending chunk to JetStream: %v", err)
+}
+
+// stored records the acknowledgement of a chunk.
+func (fc *flowController) stored(pa *nats.PubAck) {
+	fc.lastSeq = pa.Sequence
+	if pa.Duplicate {
+		fc.dups++
+	}
+}
+
+// add records a chunk that was published.
+func (fc *flowController) add(paf nats.PubAckFuture) {
+	fc.pafs = append(fc.pafs, paf)
+}
+
+// drain waits for all of the outstanding chunks to be acknowledged.
+func (fc *flowController) drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for len(fc.pafs) > 0 {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("timed out with %d chunks still waiting to be acknowledged", len(fc.pafs))
+		}
+		if err := fc.ack(left); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fc *flowController) grow() {
+	if fc.ramping {
+		fc.window *= 2
+	} else {
+		fc.window++
+	}
+	if fc.window > maxFlowWindow {
+		fc.window = maxFlowWindow
+	}
+	fc.acked = 0
+}
+
+func (fc *flowController) shrink(reason string) {
+	fc.window /= 2
+	if fc.window < minFlowWindow {
+		fc.window = minFlowWindow
+	}
+	fc.acked, fc.ramping = 0, false
+	fc.statusf("%s, reduced publish window to %d chunks", reason, fc.window)
+}
@@ -0,0 +1,581 @@
+package xfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Levels of integrity checking for Get.
+// With VerifyGap we make sure no chunks were missed and the size matches,
+// VerifyFull, the default, also checks the SHA-256 digest of the file, and
+// VerifyNone skips the checks altogether, which may be fine on trusted links.
+// Missed chunks are always recovered regardless of the level.
+const (
+	VerifyGap  = "gap"
+	VerifyFull = "full"
+	VerifyNone = "none"
+)
+
+// checkpointInterval is how many chunks Get writes between checkpoints.
+const checkpointInterval = 256
+
+// GetOptions control how Get and GetDir retrieve a transfer.
+type GetOptions struct {
+	// Stream to retrieve from.
+	Stream string
+	// Level of integrity checking, VerifyFull if empty.
+	Verify string
+	// Maximum number of times to recover from missed chunks, 0 for no limit.
+	MaxGapRetries int
+	// Fail on missed chunks instead of recovering them.
+	NoRecover bool
+	// Wait for an in progress stream to be completed.
+	Follow bool
+	// Deliver chunks at the rate they were originally published.
+	ReplayOriginal bool
+	// Only retrieve the chunks in this window of stream sequences, 0 for
+	// unbounded. Each chunk is written at its offset in the file, so the
+	// writer must also be an io.Seeker.
+	SinceSeq, UntilSeq uint64
+	// Only retrieve Length bytes of the file starting at Offset, which are
+	// written from the start of the writer. A Length of 0 is to the end.
+	Offset, Length int64
+	// How long to wait for more chunks once we appear to have them all.
+	CompletionGrace time.Duration
+	// Maximum rate to receive at in bytes per second, 0 for no limit.
+	// Flow control slows the server down to match.
+	Rate int64
+	// Passphrase to decrypt the chunks of an encrypted transfer with.
+	Passphrase string
+	// How long to wait for each chunk before deciding no more are coming.
+	// If 0 we wait 5 seconds for the first and a second for the rest.
+	RecvTimeout time.Duration
+	// Resume continues a retrieval that was interrupted at a checkpoint.
+	// What was written up to it is read from Retrieved, so the digest still
+	// covers the whole file.
+	Resume    *Position
+	Retrieved io.Reader
+	// Checkpoint, if set, is called every so often with how far we have got,
+	// unless following or retrieving a window. Anything written so far should
+	// be made durable before recording the position.
+	Checkpoint func(pos Position)
+	// Sync each file before closing it in GetDir.
+	Sync bool
+	// Kind of consumer to retrieve with, ConsumerFlow if empty, and for
+	// ConsumerPull the most chunks to have unacknowledged at once,
+	// DefaultMaxAckPending if 0. GetDir and parallel transfers always use
+	// ConsumerFlow.
+	Mode          string
+	MaxAckPending int
+	// OnChunk, if set, is called with the stream sequence of each chunk as it arrives.
+	OnChunk func(seq uint64)
+	// Progress, if set, is called with how much has been written, at most
+	// every ProgressInterval.
+	Progress ProgressFunc
+	// Logf and Statusf, if set, report events worth keeping, such as warnings,
+	// and transient ones, such as recovering from missed chunks.
+	Logf    func(format string, args ...interface{})
+	Statusf func(format string, args ...interface{})
+	// Debugf, if set, reports detail, such as the configuration of the
+	// consumer and every chunk received.
+	Debugf func(format string, args ...interface{})
+}
+
+// Position is how far Get has got, as passed to GetOptions.Checkpoint and
+// used to resume with GetOptions.Resume.
+type Position struct {
+	Stream  string    `json:"stream"`
+	Created time.Time `json:"created"`
+	// Seq is the last stream sequence written, and Size the bytes written
+	// up to and including it.
+	Seq  uint64 `json:"seq"`
+	Size int64  `json:"size"`
+	// Index is the index of the next chunk.
+	Index int `json:"index"`
+}
+
+// lookupTransfer finds the stream to retrieve and its metadata, following
+// a reference to the stream holding the contents.
+func lookupTransfer(js nats.JetStreamContext, stream string) (*nats.StreamInfo, *Meta, error) {
+	si, err := LookupStream(js, stream)
+	if err == ErrStreamNotFound {
+		return nil, nil, fmt.Errorf("%w: %s", ErrStreamNotFound, stream)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error looking up stream %q: %v", stream, err)
+	}
+	tm, err := LookupMeta(js, si)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+	}
+	// Refuse up front rather than writing chunks we can not decompress.
+	if tm != nil && tm.Compression != "" && tm.Compression != CompressionGzip {
+		return nil, nil, fmt.Errorf("stream %q uses unsupported compression %q", stream, tm.Compression)
+	}
+	if tm != nil && tm.Encryption != "" && tm.Encryption != EncryptionAESGCM {
+		return nil, nil, fmt.Errorf("stream %q uses unsupported encryption %q", stream, tm.Encryption)
+	}
+	if tm != nil && tm.Ref != "" {
+		if si, tm, err = LookupRef(js, tm); err != nil {
+			return nil, nil, fmt.Errorf("error following %q to stream %q: %v", stream, tm.Ref, err)
+		}
+	}
+	return si, tm, nil
+}
+
+// nextMsg waits up to timeout for the next message on sub, returning
+// nats.ErrTimeout if none arrives, or the error of ctx once it is done.
+func nextMsg(ctx context.Context, sub *nats.Subscription, timeout time.Duration) (*nats.Msg, error) {
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	m, err := sub.NextMsgWithContext(tctx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, nats.ErrTimeout
+	}
+	return m, err
+}
+
+// recvTimeout returns how long to wait for a chunk, def unless set in opts.
+func recvTimeout(opts GetOptions, def time.Duration) time.Duration {
+	if opts.RecvTimeout > 0 {
+		return opts.RecvTimeout
+	}
+	return def
+}
+
+// Get retrieves the transfer in opts.Stream, writing the file to w. The file
+// is verified as it arrives according to opts.Verify, and a failed check is
+// returned as an error once everything has been written. If ctx is done
+// before then Get stops and returns its error, leaving what was written.
+func Get(ctx context.Context, js nats.JetStreamContext, w io.Writer, opts GetOptions) (*Result, error) {
+	si, tm, err := lookupTransfer(js, opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	stream := si.Config.Name
+	if tm != nil && tm.Dir {
+		return nil, fmt.Errorf("stream %q holds a directory, which is retrieved with GetDir", stream)
+	}
+	if tm != nil && tm.Encryption != "" && opts.Passphrase == "" {
+		return nil, fmt.Errorf("stream %q: %w", stream, ErrNoPassphrase)
+	}
+	dec := NewDecrypter(opts.Passphrase)
+	lim := newLimiter(opts.Rate)
+	checkExpiry(si, func(format string, args ...interface{}) {
+		logf(opts.Logf, format, args...)
+	})
+	if tm == nil && !opts.Follow {
+		if live, err := InProgress(js, si); err != nil {
+			return nil, fmt.Errorf("error checking stream %q: %v", stream, err)
+		} else if live {
+			logf(opts.Logf, "Stream %q is still in progress, retrieving what is available", stream)
+		}
+	}
+	verify := opts.Verify
+	if verify == "" {
+		verify = VerifyFull
+	}
+
+	// We go by the sequences in the stream rather than its message count,
+	// which no longer matches them once messages have been removed.
+	first, last := si.State.FirstSeq, si.State.LastSeq
+	if first == 0 {
+		first = 1
+	}
+	// A stream whose first messages were purged or expired is missing the
+	// start of the file, unless they were never part of it, as when a put
+	// went into a stream that was emptied ahead of time.
+	ranged := opts.Offset > 0 || opts.Length > 0
+	if si.State.FirstSeq > 1 && opts.Resume == nil && opts.SinceSeq == 0 && !ranged && !firstChunkFirst(js, si) {
+		if verify != VerifyNone {
+			return nil, purged(si, 1)
+		}
+		logf(opts.Logf, "Warning: stream %q starts at sequence %d, its earlier messages were removed", stream, first)
+	}
+
+	// Check any window we were asked for against the chunks in the stream.
+	window := opts.SinceSeq > 0 || opts.UntilSeq > 0
+	var seeker io.Seeker
+	if window && ranged {
+		return nil, errors.New("can not retrieve both a window of sequences and a range of bytes")
+	}
+	if window {
+		if tm == nil || tm.Completion != CompletionTrailer || opts.Follow {
+			return nil, errors.New("retrieving a window of sequences requires a completed transfer with metadata")
+		}
+		var ok bool
+		if seeker, ok = w.(io.Seeker); !ok {
+			return nil, errors.New("retrieving a window of sequences requires a destination that can seek")
+		}
+		first, last = si.State.FirstSeq, si.State.LastSeq-1
+		if opts.SinceSeq > 0 {
+			first = opts.SinceSeq
+		}
+		if opts.UntilSeq > 0 {
+			last = opts.UntilSeq
+		}
+		if first < si.State.FirstSeq || last >= si.State.LastSeq || first > last {
+			return nil, fmt.Errorf("invalid window %d-%d, stream %q has chunks %d-%d",
+				first, last, stream, si.State.FirstSeq, si.State.LastSeq-1)
+		}
+	}
+	// A range of bytes is a window of the chunks holding it, trimmed to size.
+	skip, remaining := 0, int64(0)
+	if ranged {
+		if tm == nil || tm.Completion != CompletionTrailer || opts.Follow {
+			return nil, errors.New("retrieving a range of bytes requires a completed transfer with metadata")
+		}
+		if opts.Offset < 0 || opts.Length < 0 || opts.Offset >= tm.Size || opts.Offset+opts.Length > tm.Size {
+			return nil, fmt.Errorf("invalid range of %d bytes at offset %d, %q holds %d bytes", opts.Length, opts.Offset, stream, tm.Size)
+		}
+		remaining = opts.Length
+		if remaining == 0 {
+			remaining = tm.Size - opts.Offset
+		}
+		cs := int64(tm.ChunkSize)
+		first = si.State.FirstSeq + uint64(opts.Offset/cs)
+		last = si.State.FirstSeq + uint64((opts.Offset+remaining-1)/cs)
+		skip = int(opts.Offset % cs)
+		if last >= si.State.LastSeq {
+			return nil, integrityErrorf("stream %q does not hold all of the chunks of %q", stream, tm.Name)
+		}
+		window = true
+	}
+	// A stream that never had a message, such as one whose put was stopped
+	// before sending anything, holds an empty file. Without following there
+	// is nothing to wait for.
+	if si.State.LastSeq == 0 && !opts.Follow {
+		logf(opts.Debugf, "Stream %q is empty", stream)
+		newProgressReporter(opts.Progress, 0, 0).finish()
+		return &Result{Stream: stream}, nil
+	}
+	if tm != nil && len(tm.RegionDigests) > 0 {
+		if window || opts.Follow || opts.Resume != nil {
+			return nil, fmt.Errorf("stream %q holds a parallel transfer, which can not be followed, resumed or retrieved in part", stream)
+		}
+		return getParallel(ctx, js, si, tm, w, opts, verify)
+	}
+	// Unless we are following or only retrieving part of the stream, we keep
+	// track of what we have written so an interrupted get can be resumed.
+	resumable := !window && !opts.Follow
+	rs := opts.Resume
+	if rs != nil {
+		if !resumable {
+			return nil, errors.New("can not resume when following or retrieving a window")
+		}
+		if rs.Stream != stream || !rs.Created.Equal(si.Created) {
+			return nil, fmt.Errorf("can not resume, stream %q has changed since it was interrupted", stream)
+		}
+		first = rs.Seq + 1
+	}
+
+	// We have multiple options here with respect to configuring a consumer.
+	// We care about not being a slow consumer and recovering from any dataloss or missed chunks.
+	// We could do a replay controller rate, or max ack pending, or even a pull based consumer.
+	// However with this scenario, we really do not need acks or redeliveries and can use the new
+	// flowcontrol option to control bandwidth. We can use the consumer sequences to detect any missed
+	// chunks. A pull consumer with acks is there for when flow control does not suit, and missed
+	// chunks are detected the same way.
+	if err := checkMode(opts); err != nil {
+		return nil, err
+	}
+	src, err := newChunkSource(js, stream, si.Config.Subjects[0], first, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { src.close() }()
+
+	// If the stream is deleted and recreated while we are running, say by a
+	// concurrent put, our sequences are no longer valid. We detect this with
+	// the stream's creation time.
+	checkStreamIdentity := func() error {
+		csi, err := js.StreamInfo(stream)
+		if isNotFound(err) {
+			return fmt.Errorf("source stream %q was deleted during retrieval", stream)
+		} else if err == nil && !csi.Created.Equal(si.Created) {
+			return fmt.Errorf("source stream %q changed during retrieval", stream)
+		}
+		return nil
+	}
+
+	res := &Result{Stream: stream}
+	bytes, eseq := int64(0), first
+	// Chunks from newer versions carry their index and the number of chunks,
+	// which we check independently of the stream sequences. We learn the
+	// first index of a window from its first chunk.
+	nextIndex, total := 0, -1
+	if window {
+		nextIndex = -1
+	}
+	if ranged {
+		nextIndex = int(opts.Offset / int64(tm.ChunkSize))
+	}
+	if rs != nil {
+		bytes, nextIndex = rs.Size, rs.Index
+	}
+	placed := !window || ranged
+	// The metadata is not part of the file.
+	// If we have it and were asked to we will also verify the digest as
+	// chunks arrive, unless we are only retrieving a window of the file.
+	var dv *digestVerifier
+	if tm != nil && !window {
+		last--
+	}
+	if (tm != nil || opts.Follow) && !window && verify == VerifyFull {
+		dv = newDigestVerifier()
+		// What we already have when resuming needs to be hashed as well.
+		if rs != nil {
+			if opts.Retrieved == nil {
+				return nil, errors.New("can not verify a resumed retrieval without what was already retrieved")
+			}
+			if err := dv.addFrom(opts.Retrieved, rs.Size); err != nil {
+				return nil, fmt.Errorf("error reading what was already retrieved: %v", err)
+			}
+		}
+	}
+	// With a trailer we read until we see it instead of relying on the message count.
+	// When following we always wait for the trailer.
+	trailer := !window && (opts.Follow || (tm != nil && tm.Completion == CompletionTrailer))
+	done := false
+
+	// Without a trailer a put may still be adding chunks when we reach what
+	// looked like the end. After the grace period we check whether the stream
+	// has grown, and if so keep going, now waiting for the trailer if one was
+	// written. Reports whether we should keep going.
+	grown := func() bool {
+		if opts.CompletionGrace <= 0 || window {
+			return false
+		}
+		select {
+		case <-time.After(opts.CompletionGrace):
+		case <-ctx.Done():
+			return false
+		}
+		csi, err := js.StreamInfo(stream)
+		if err != nil || csi.State.LastSeq <= last || !csi.Created.Equal(si.Created) {
+			return false
+		}
+		logf(opts.Statusf, "Stream %q grew to %d messages, continuing", stream, csi.State.Msgs)
+		if ntm, err := LookupMeta(js, csi); err == nil && ntm != nil && ntm.Completion == CompletionTrailer {
+			tm, trailer = ntm, true
+		}
+		last = csi.State.LastSeq
+		return true
+	}
+
+	// Chunks are written by their own go routine while we receive the next.
+	var already int64
+	if rs != nil {
+		already = rs.Size
+	}
+	size := int64(-1)
+	if ranged {
+		size = remaining
+	} else if tm != nil && !window && !opts.Follow {
+		size = tm.Size
+	}
+	pr := newProgressReporter(opts.Progress, already, size)
+	cw := newChunkWriter(w, pr.add)
+	defer cw.close()
+	var rm recvMeter
+	var recvErr error
+
+	// Loop over our inbound messages.
+	for wait := recvTimeout(opts, 5*time.Second); ; wait = recvTimeout(opts, time.Second) {
+		start := time.Now()
+		m, err := src.next(ctx, wait)
+		// Following or replaying at the original rate can have long pauses between chunks.
+		if err == nats.ErrTimeout && (opts.Follow || opts.ReplayOriginal) {
+			continue
+		} else if err == nats.ErrTimeout && cw.busy() {
+			// We are waiting on our own writes, which a pull consumer needs
+			// acked before it fetches more.
+			continue
+		} else if err == nats.ErrSlowConsumer {
+			if opts.NoRecover {
+				return nil, integrityErrorf("chunks of %q were dropped: %v", stream, err)
+			}
+			// Dropped chunks show up as a gap and are recovered below.
+			continue
+		} else if err != nil {
+			recvErr = err
+			break
+		}
+		rm.waited(time.Since(start))
+		rm.add(len(m.Data))
+		meta, err := m.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		index := HeaderInt(m.Header, HeaderChunkIndex)
+		// The stream can have holes that are not chunks, such as removed messages.
+		// If this is the chunk we expect, or the trailer once we have all of the
+		// chunks, we have not missed anything.
+		if meta.Sequence.Stream > eseq && nextIndex >= 0 {
+			if index == nextIndex || (trailer && m.Header.Get(HeaderMeta) != "" && nextIndex == total) {
+				eseq = meta.Sequence.Stream
+			}
+		}
+		if eseq != meta.Sequence.Stream {
+			if opts.NoRecover {
+				return nil, integrityErrorf("missed chunk sequence in %q, expected %d but got %d", stream, eseq, meta.Sequence.Stream)
+			}
+			if err := chunksGone(js, stream, eseq); err != nil {
+				return nil, err
+			}
+			res.Gaps++
+			if opts.MaxGapRetries > 0 && res.Gaps > opts.MaxGapRetries {
+				return nil, integrityErrorf("giving up on %q after recovering from %d gaps, last expected %d but got %d",
+					stream, opts.MaxGapRetries, eseq, meta.Sequence.Stream)
+			}
+			logf(opts.Statusf, "Missed chunk sequence, expected %d but got %d, resetting", eseq, meta.Sequence.Stream)
+			if err := checkStreamIdentity(); err != nil {
+				return nil, err
+			}
+			src.close()
+			// Our deferred close needs a source even if we fail to get a new one.
+			nsrc, err := newChunkSource(js, stream, si.Config.Subjects[0], eseq, opts)
+			if err != nil {
+				return nil, err
+			}
+			src = nsrc
+			continue
+		}
+		// Trailers before the last message were superseded by recover.
+		if m.Header.Get(HeaderMeta) != "" && !opts.Follow && meta.Sequence.Stream < si.State.LastSeq {
+			src.done(m)
+			eseq++
+			continue
+		}
+		if trailer && m.Header.Get(HeaderMeta) != "" {
+			// When following we learn the metadata from the trailer itself.
+			if tm, err = ParseMeta(m.Header); err != nil {
+				return nil, fmt.Errorf("error reading metadata for stream %q: %v", stream, err)
+			}
+			done = true
+			break
+		}
+
+		if m.Header.Get(HeaderEntry) != "" {
+			return nil, fmt.Errorf("stream %q holds a directory whose transfer is not complete", stream)
+		}
+		if index >= 0 && nextIndex >= 0 && index != nextIndex && verify != VerifyNone {
+			return nil, integrityErrorf("chunk out of order in %q, expected chunk %d but got %d", stream, nextIndex, index)
+		}
+		if !placed {
+			// A window of chunks is written at its offset in the original file.
+			offset := int64(first-1) * int64(tm.ChunkSize)
+			if index >= 0 {
+				offset = int64(index) * int64(tm.ChunkSize)
+			}
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("error seeking in file: %v", err)
+			}
+			nextIndex, placed = index, true
+		}
+		if t := HeaderInt(m.Header, HeaderChunkTotal); t >= 0 {
+			total = t
+		}
+		if opts.OnChunk != nil {
+			opts.OnChunk(meta.Sequence.Stream)
+		}
+
+		if err := lim.wait(ctx, len(m.Data)); err != nil {
+			return nil, err
+		}
+		// Queue the chunk for our file.
+		data, err := dec.ChunkData(m.Header, m.Data)
+		if err == ErrNoPassphrase {
+			return nil, fmt.Errorf("stream %q: %w", stream, err)
+		} else if err != nil {
+			return nil, integrityErrorf("error reading chunk at sequence %d of %q: %v", meta.Sequence.Stream, stream, err)
+		}
+		if ranged {
+			if skip > len(data) {
+				return nil, integrityErrorf("chunk at sequence %d of %q is shorter than its chunk size", meta.Sequence.Stream, stream)
+			}
+			if data, skip = data[skip:], 0; int64(len(data)) > remaining {
+				data = data[:remaining]
+			}
+			remaining -= int64(len(data))
+		}
+		// A pull consumer redelivers the chunk unless it is acked, which we
+		// only do once it is in the file. The source may have been replaced
+		// by then.
+		ack := src.done
+		if err := cw.write(ctx, data, func() { ack(m) }); err != nil {
+			return nil, err
+		}
+		logf(opts.Debugf, "Received chunk at sequence %d, %d bytes", meta.Sequence.Stream, len(data))
+		bytes += int64(len(data))
+		res.Chunks++
+		if dv != nil {
+			dv.add(data)
+		}
+
+		// Check to see if we are done.
+		eseq++
+		if nextIndex >= 0 {
+			nextIndex++
+		}
+		if resumable && opts.Checkpoint != nil && (eseq-first)%checkpointInterval == 0 {
+			// What we record must have been written.
+			if err := cw.flush(); err != nil {
+				return nil, err
+			}
+			opts.Checkpoint(Position{stream, si.Created, eseq - 1, bytes, nextIndex})
+		}
+		if !trailer && eseq > last && !grown() {
+			done = true
+			break
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := cw.close(); err != nil {
+		return nil, err
+	}
+	// A stream that was replaced also explains chunks that stopped coming.
+	if err := checkStreamIdentity(); err != nil {
+		return nil, err
+	}
+	// Chunks that stopped coming are checked for below, anything else that
+	// ended the loop, such as a closed connection, is not about integrity.
+	if !done && recvErr != nats.ErrTimeout {
+		return nil, fmt.Errorf("error receiving chunks of %q: %v", stream, recvErr)
+	}
+	if trailer && !done && verify != VerifyNone {
+		return nil, integrityErrorf("transfer of %q incomplete, did not receive the trailer", stream)
+	}
+	if !trailer && !done && verify != VerifyNone {
+		return nil, integrityErrorf("transfer of %q incomplete, stopped at sequence %d of %d", stream, eseq, last)
+	}
+	// Without checks we still know when we did not get everything.
+	if !done {
+		return nil, fmt.Errorf("transfer of %q incomplete, timed out waiting for chunks", stream)
+	}
+	if !window && verify != VerifyNone && total >= 0 && nextIndex != total {
+		return nil, integrityErrorf("transfer of %q incomplete, expected %d chunks but got %d", stream, total, nextIndex)
+	}
+	if tm != nil && !window && verify != VerifyNone && bytes != tm.Size {
+		return nil, integrityErrorf("size mismatch for %q, expected %d bytes but got %d", stream, tm.Size, bytes)
+	}
+	if ranged && verify != VerifyNone && remaining != 0 {
+		return nil, integrityErrorf("range of %q incomplete, %d bytes short", stream, remaining)
+	}
+	if dv != nil {
+		if sum := dv.sum(); sum != tm.Digest {
+			return nil, integrityErrorf("checksum mismatch for %q, expected SHA-256 %s but got %s, retrieved file is corrupt", stream, tm.Digest, sum)
+		}
+		logf(opts.Debugf, "Verified %q while writing it, hashing took %v", stream, dv.hashed)
+	}
+	res.Bytes, res.Meta = bytes, tm
+	rm.report(res)
+	pr.finish()
+	return res, nil
+}
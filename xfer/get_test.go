@@ -0,0 +1,307 @@
+package xfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// waitMsgs waits for stream to hold n messages.
+func waitMsgs(t *testing.T, js nats.JetStreamContext, stream string, n uint64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if si, err := js.StreamInfo(stream); err == nil && si.State.Msgs >= n {
+			return
+		}
+	}
+	t.Fatalf("Stream %q did not reach %d messages", stream, n)
+}
+
+func TestIndexesDivergeFromSequences(t *testing.T) {
+	_, js := runServer(t)
+	const cs = 1024
+	// The stream was created ahead of time and held messages that were
+	// purged, so the first chunk is not at sequence 1.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "diverge", Subjects: []string{"diverge"}}); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := js.Publish("diverge", []byte("unrelated")); err != nil {
+			t.Fatalf("Error publishing: %v", err)
+		}
+	}
+	if err := js.PurgeStream("diverge"); err != nil {
+		t.Fatalf("Error purging stream: %v", err)
+	}
+
+	_, data := randomFile(t, "diverge.bin", 10*cs+5)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Put(context.Background(), js, pr, PutOptions{
+			Stream:        "diverge",
+			Name:          "diverge.bin",
+			ChunkSize:     cs,
+			AllowExisting: true,
+		})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	// Halfway through, an unrelated message is stored between the chunks and
+	// removed again, leaving a hole in the sequences.
+	if _, err := pw.Write(data[:5*cs]); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	waitMsgs(t, js, "diverge", 5)
+	pa, err := js.Publish("diverge", []byte("unrelated"))
+	if err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if err := js.DeleteMsg("diverge", pa.Sequence); err != nil {
+		t.Fatalf("Error deleting message: %v", err)
+	}
+	if _, err := pw.Write(data[5*cs:]); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Error putting: %v", err)
+	}
+
+	si, err := js.StreamInfo("diverge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.State.FirstSeq != 4 || si.State.LastSeq != si.State.FirstSeq+si.State.Msgs {
+		t.Fatalf("Expected chunks from sequence 4 with a hole, got %+v", si.State)
+	}
+	for _, mode := range []string{ConsumerFlow, ConsumerPull} {
+		got, res := getBytes(t, js, "diverge", GetOptions{Mode: mode})
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: retrieved %d bytes that differ from the %d put", mode, len(got), len(data))
+		}
+		if res.Chunks != 11 || res.Gaps != 0 {
+			t.Fatalf("%s: retrieved %d chunks with %d gaps, expected 11 without any", mode, res.Chunks, res.Gaps)
+		}
+	}
+}
+
+func TestStreamRecreatedDuringGet(t *testing.T) {
+	_, js := runServer(t)
+	path, _ := randomFile(t, "recreated.bin", 20*1024)
+	putFile(t, js, "recreated", path, PutOptions{ChunkSize: 1024})
+	other, _ := randomFile(t, "other.bin", 30*1024)
+
+	for _, mode := range []string{ConsumerFlow, ConsumerPull} {
+		t.Run(mode, func(t *testing.T) {
+			// Partway through, a concurrent put replaces the stream.
+			recreated := false
+			opts := GetOptions{Stream: "recreated", Mode: mode, MaxAckPending: 4, RecvTimeout: 250 * time.Millisecond}
+			opts.OnChunk = func(seq uint64) {
+				if seq != 3 || recreated {
+					return
+				}
+				recreated = true
+				if err := js.DeleteStream("recreated"); err != nil {
+					t.Errorf("Error deleting stream: %v", err)
+				}
+				putFile(t, js, "recreated", other, PutOptions{ChunkSize: 1024})
+			}
+			_, err := Get(context.Background(), js, &bytes.Buffer{}, opts)
+			if err == nil || !strings.Contains(err.Error(), "changed during retrieval") {
+				t.Fatalf("Expected the stream to have changed, got %v", err)
+			}
+			// Put it back for the next mode.
+			if err := js.DeleteStream("recreated"); err != nil {
+				t.Fatal(err)
+			}
+			putFile(t, js, "recreated", path, PutOptions{ChunkSize: 1024})
+		})
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	_, js := runServer(t)
+	// A put that was stopped before sending anything leaves a stream
+	// without messages.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "empty", Subjects: []string{"empty"}}); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	start := time.Now()
+	got, res := getBytes(t, js, "empty", GetOptions{})
+	if len(got) != 0 || res.Bytes != 0 || res.Chunks != 0 {
+		t.Fatalf("Retrieved %d bytes in %d chunks from an empty stream", res.Bytes, res.Chunks)
+	}
+	// Nothing is waited for.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Retrieving an empty stream took %v", elapsed)
+	}
+}
+
+func TestUncheckedGetStoppedShort(t *testing.T) {
+	path, _ := randomFile(t, "short.bin", 20*1024)
+	for _, mode := range []string{ConsumerFlow, ConsumerPull} {
+		t.Run(mode, func(t *testing.T) {
+			// Without checks, a get that loses its connection or stops
+			// receiving chunks still fails rather than leaving a short file.
+			nc, js := runServer(t)
+			putFile(t, js, "short", path, PutOptions{ChunkSize: 1024})
+			opts := GetOptions{Stream: "short", Mode: mode, Verify: VerifyNone, MaxAckPending: 4, RecvTimeout: 250 * time.Millisecond}
+			opts.OnChunk = func(seq uint64) {
+				if seq == 3 {
+					nc.Close()
+				}
+			}
+			if _, err := Get(context.Background(), js, &bytes.Buffer{}, opts); err == nil {
+				t.Fatalf("Get succeeded after the connection was closed")
+			}
+
+			_, js = runServer(t)
+			putFile(t, js, "short", path, PutOptions{ChunkSize: 1024})
+			// The trailer is lost and nothing comes after it.
+			dropChunks(t, 21)
+			opts.OnChunk = nil
+			_, err := Get(context.Background(), js, &bytes.Buffer{}, opts)
+			if err == nil || !strings.Contains(err.Error(), "incomplete") {
+				t.Fatalf("Expected the transfer to be incomplete, got %v", err)
+			}
+		})
+	}
+}
+
+// slowWriter takes a while to write each chunk, counting what it wrote.
+type slowWriter struct {
+	mu      sync.Mutex
+	written int
+	delay   time.Duration
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(sw.delay)
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.written += len(p)
+	return len(p), nil
+}
+
+func (sw *slowWriter) total() int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.written
+}
+
+// ackCheckSource calls check with every message it is done with.
+type ackCheckSource struct {
+	chunkSource
+	check func(m *nats.Msg)
+}
+
+func (as *ackCheckSource) done(m *nats.Msg) {
+	as.check(m)
+	as.chunkSource.done(m)
+}
+
+func TestPullAcksWrittenChunks(t *testing.T) {
+	_, js := runServer(t)
+	const cs = 1024
+	path, data := randomFile(t, "acked.bin", 20*cs+10)
+	putFile(t, js, "acked", path, PutOptions{ChunkSize: cs})
+
+	// Writing takes longer than we wait for chunks, and each chunk is
+	// acked only once the writer has it.
+	sw := &slowWriter{delay: 20 * time.Millisecond}
+	var acked int32
+	newChunkSource = func(js nats.JetStreamContext, stream, subj string, seq uint64, opts GetOptions) (chunkSource, error) {
+		src, err := openChunkSource(js, stream, subj, seq, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &ackCheckSource{src, func(m *nats.Msg) {
+			if m.Header.Get(HeaderMeta) != "" {
+				return
+			}
+			atomic.AddInt32(&acked, 1)
+			end := (HeaderInt(m.Header, HeaderChunkIndex) + 1) * cs
+			if end > len(data) {
+				end = len(data)
+			}
+			if written := sw.total(); written < end {
+				t.Errorf("Chunk ending at %d acked with only %d bytes written", end, written)
+			}
+		}}, nil
+	}
+	t.Cleanup(func() { newChunkSource = openChunkSource })
+
+	res, err := Get(context.Background(), js, sw, GetOptions{Stream: "acked", Mode: ConsumerPull, MaxAckPending: 4, RecvTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if res.Bytes != int64(len(data)) || sw.total() != len(data) {
+		t.Fatalf("Retrieved %d bytes, wrote %d, expected %d", res.Bytes, sw.total(), len(data))
+	}
+	if n := atomic.LoadInt32(&acked); n != 21 {
+		t.Fatalf("Acked %d chunks, expected 21", n)
+	}
+}
+
+func TestResubscribeFails(t *testing.T) {
+	_, js := runServer(t)
+	path, _ := randomFile(t, "resub.bin", 20*1024)
+	putFile(t, js, "resub", path, PutOptions{ChunkSize: 1024})
+
+	for _, mode := range []string{ConsumerFlow, ConsumerPull} {
+		t.Run(mode, func(t *testing.T) {
+			// A chunk is missed, and the consumer to recover it can not be created.
+			opened := 0
+			newChunkSource = func(js nats.JetStreamContext, stream, subj string, seq uint64, opts GetOptions) (chunkSource, error) {
+				if opened++; opened > 1 {
+					return nil, errors.New("no consumer for you")
+				}
+				src, err := openChunkSource(js, stream, subj, seq, opts)
+				if err != nil {
+					return nil, err
+				}
+				return &droppingSource{src, map[uint64]bool{3: true}}, nil
+			}
+			t.Cleanup(func() { newChunkSource = openChunkSource })
+			_, err := Get(context.Background(), js, &bytes.Buffer{}, GetOptions{Stream: "resub", Mode: mode})
+			if err == nil || !strings.Contains(err.Error(), "no consumer for you") {
+				t.Fatalf("Expected the error creating the consumer, got %v", err)
+			}
+
+			// Failing for real gives no source at all, not a typed nil one.
+			if src, err := openChunkSource(js, "missing", "missing", 1, GetOptions{Mode: mode}); err == nil || src != nil {
+				t.Fatalf("Expected no source and an error, got %v, %v", src, err)
+			}
+		})
+	}
+}
+
+func TestReportsHashingTime(t *testing.T) {
+	_, js := runServer(t)
+	path, data := randomFile(t, "hashed.bin", 64*1024)
+	putFile(t, js, "hashed", path, PutOptions{ChunkSize: 1024})
+
+	var debug []string
+	got, _ := getBytes(t, js, "hashed", GetOptions{Debugf: func(format string, args ...interface{}) {
+		debug = append(debug, fmt.Sprintf(format, args...))
+	}})
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+	}
+	for _, line := range debug {
+		if strings.HasPrefix(line, `Verified "hashed" while writing it, hashing took `) {
+			return
+		}
+	}
+	t.Fatalf("Expected the hashing time to be reported, got %q", debug)
+}
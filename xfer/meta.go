@@ -0,0 +1,295 @@
+package xfer
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Headers used to describe a transfer. These are carried on a final metadata
+// message, or trailer, that Put places in the stream after all of the chunks.
+const (
+	HeaderPrefix    = "Njs-Xfer-"
+	HeaderMeta      = "Njs-Xfer-Meta"
+	HeaderName      = "Njs-Xfer-Name"
+	HeaderModTime   = "Njs-Xfer-Mtime"
+	HeaderSize      = "Njs-Xfer-Size"
+	HeaderChunkSize = "Njs-Xfer-Chunk-Size"
+	HeaderDigest    = "Njs-Xfer-Sha256"
+	HeaderComplete  = "Njs-Xfer-Completion"
+	// The MIME type of the file, as detected on put.
+	HeaderContentType = "Njs-Xfer-Content-Type"
+	// How the chunks were compressed, if at all.
+	HeaderCompression = "Njs-Xfer-Compression"
+	// How the chunks were encrypted, if at all, and the salt for the key.
+	HeaderEncryption = "Njs-Xfer-Encryption"
+	HeaderSalt       = "Njs-Xfer-Salt"
+	// A transfer whose contents are stored in another stream.
+	HeaderRef = "Njs-Xfer-Ref"
+	// Each chunk carries its index, starting at 0, and the number of
+	// chunks in the transfer when known up front, i.e. when not following.
+	HeaderChunkIndex = "Njs-Xfer-Chunk-Index"
+	HeaderChunkTotal = "Njs-Xfer-Chunk-Total"
+	// The length and CRC-32C, in hex, of each chunk's data as stored, i.e.
+	// after any compression or encryption, so corruption can be pinpointed.
+	HeaderChunkLength = "Njs-Xfer-Chunk-Length"
+	HeaderChunkCRC    = "Njs-Xfer-Chunk-Crc32c"
+	// Marks chunks from a put that is following a growing file.
+	// The stream is in progress until the trailer is written.
+	HeaderLive = "Njs-Xfer-Live"
+	// A parallel transfer, see PutOptions.Parallel, records how many chunks
+	// each region holds and the hex encoded SHA-256 digest of each region,
+	// separated by commas.
+	HeaderRegionChunks  = "Njs-Xfer-Region-Chunks"
+	HeaderRegionDigests = "Njs-Xfer-Region-Sha256"
+	// Marks a transfer of a directory, see PutDir, or of a tar archive of
+	// one, see PutTar.
+	HeaderType = "Njs-Xfer-Type"
+	// Describes an entry of a directory transfer. Each file's chunks follow
+	// its entry, which also carries the size and modification time.
+	HeaderEntry = "Njs-Xfer-Entry"
+	HeaderPath  = "Njs-Xfer-Path"
+	HeaderMode  = "Njs-Xfer-Mode"
+	// A file entry stored with PutOptions.Dedup has no chunks, and instead
+	// gives the path of an earlier file with the same contents.
+	HeaderSame = "Njs-Xfer-Same"
+)
+
+// Transfer and entry types for directories.
+const (
+	TypeDir   = "dir"
+	TypeTar   = "tar"
+	EntryDir  = "dir"
+	EntryFile = "file"
+)
+
+// How Get decides that it has received all of the chunks.
+// With CompletionTrailer it reads until it sees the metadata message,
+// which makes it independent of the stream's message count.
+// Streams without a completion header use CompletionCount.
+const (
+	CompletionCount   = "count"
+	CompletionTrailer = "trailer"
+)
+
+// metaVersion is the version of the metadata layout we write.
+const metaVersion = "1"
+
+// Meta holds the metadata for a transfer.
+type Meta struct {
+	Name      string
+	Size      int64
+	ChunkSize int
+	Digest    string
+	// How get detects the end of the transfer.
+	Completion string
+	// Compression used for the chunks, empty for none.
+	Compression string
+	// Encryption used for the chunks, empty for none, and the hex encoded
+	// salt its key was derived with.
+	Encryption string
+	Salt       string
+	// Stream holding the chunks when they are not in this one.
+	Ref string
+	// Modification time of the file, zero if unknown, e.g. for a pipe.
+	ModTime time.Time
+	// Permission bits of the file, zero if unknown.
+	Mode os.FileMode
+	// Whether this is a directory, whose chunks are preceded by entries.
+	Dir bool
+	// Whether the file is a tar archive of a directory, see PutTar.
+	Tar bool
+	// MIME type of the file, empty if unknown, e.g. from older versions.
+	ContentType string
+	// A parallel transfer's chunks are split into regions of RegionChunks
+	// consecutive chunks, the last one possibly shorter, with the digest of
+	// each region's contents. Both are empty for a sequential transfer.
+	RegionChunks  int
+	RegionDigests []string
+}
+
+// Header encodes the metadata as message headers.
+func (tm *Meta) Header() http.Header {
+	hdr := http.Header{}
+	hdr.Set(HeaderMeta, metaVersion)
+	hdr.Set(HeaderName, tm.Name)
+	hdr.Set(HeaderSize, strconv.FormatInt(tm.Size, 10))
+	hdr.Set(HeaderChunkSize, strconv.Itoa(tm.ChunkSize))
+	hdr.Set(HeaderDigest, tm.Digest)
+	hdr.Set(HeaderComplete, tm.Completion)
+	if tm.Compression != "" {
+		hdr.Set(HeaderCompression, tm.Compression)
+	}
+	if tm.Encryption != "" {
+		hdr.Set(HeaderEncryption, tm.Encryption)
+		hdr.Set(HeaderSalt, tm.Salt)
+	}
+	if tm.Ref != "" {
+		hdr.Set(HeaderRef, tm.Ref)
+	}
+	if !tm.ModTime.IsZero() {
+		hdr.Set(HeaderModTime, tm.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+	if tm.Mode != 0 {
+		hdr.Set(HeaderMode, strconv.FormatUint(uint64(tm.Mode), 8))
+	}
+	if tm.Dir {
+		hdr.Set(HeaderType, TypeDir)
+	} else if tm.Tar {
+		hdr.Set(HeaderType, TypeTar)
+	}
+	if tm.ContentType != "" {
+		hdr.Set(HeaderContentType, tm.ContentType)
+	}
+	if len(tm.RegionDigests) > 0 {
+		hdr.Set(HeaderRegionChunks, strconv.Itoa(tm.RegionChunks))
+		hdr.Set(HeaderRegionDigests, strings.Join(tm.RegionDigests, ","))
+	}
+	return hdr
+}
+
+// ParseMeta decodes metadata from message headers.
+// Will return nil with no error if the headers do not represent metadata.
+func ParseMeta(hdr http.Header) (*Meta, error) {
+	if hdr.Get(HeaderMeta) == "" {
+		return nil, nil
+	}
+	tm := &Meta{
+		Name:        hdr.Get(HeaderName),
+		Digest:      hdr.Get(HeaderDigest),
+		Completion:  hdr.Get(HeaderComplete),
+		Compression: hdr.Get(HeaderCompression),
+		Encryption:  hdr.Get(HeaderEncryption),
+		Salt:        hdr.Get(HeaderSalt),
+		Ref:         hdr.Get(HeaderRef),
+		Dir:         hdr.Get(HeaderType) == TypeDir,
+		Tar:         hdr.Get(HeaderType) == TypeTar,
+		ContentType: hdr.Get(HeaderContentType),
+	}
+	if tm.Completion == "" {
+		tm.Completion = CompletionCount
+	}
+	var err error
+	if tm.Size, err = strconv.ParseInt(hdr.Get(HeaderSize), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size in metadata: %v", err)
+	}
+	if tm.ChunkSize, err = strconv.Atoi(hdr.Get(HeaderChunkSize)); err != nil {
+		return nil, fmt.Errorf("invalid chunk size in metadata: %v", err)
+	}
+	if mt := hdr.Get(HeaderModTime); mt != "" {
+		if tm.ModTime, err = time.Parse(time.RFC3339Nano, mt); err != nil {
+			return nil, fmt.Errorf("invalid modification time in metadata: %v", err)
+		}
+	}
+	if m := hdr.Get(HeaderMode); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode in metadata: %v", err)
+		}
+		tm.Mode = os.FileMode(mode).Perm()
+	}
+	if rd := hdr.Get(HeaderRegionDigests); rd != "" {
+		tm.RegionDigests = strings.Split(rd, ",")
+		if tm.RegionChunks, err = strconv.Atoi(hdr.Get(HeaderRegionChunks)); err != nil || tm.RegionChunks <= 0 {
+			return nil, fmt.Errorf("invalid region size in metadata")
+		}
+	}
+	if tm.Name == "" || tm.Digest == "" {
+		return nil, fmt.Errorf("incomplete metadata")
+	}
+	return tm, nil
+}
+
+// LocalName returns the name to give the file when it is retrieved, which is
+// the original name without any directories, or "" if there is no usable name.
+func (tm *Meta) LocalName() string {
+	name := filepath.Base(tm.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return name
+}
+
+// RestoreMode gives path the permission bits recorded for it, if any.
+// It does nothing on Windows, which has no such permissions.
+func RestoreMode(path string, mode os.FileMode) error {
+	if mode == 0 || runtime.GOOS == "windows" {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+// contentType returns the MIME type of a file from its extension, or failing
+// that from its first chunk, which may be nil. Anything we can not tell is
+// application/octet-stream.
+func contentType(name string, data []byte) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	if len(data) == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(data)
+}
+
+// HeaderInt returns the value of a numeric chunk header, or -1 if the
+// chunk does not have it, e.g. because it was written by an older version.
+func HeaderInt(hdr http.Header, key string) int {
+	n, err := strconv.Atoi(hdr.Get(key))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// LookupMeta will return the metadata for the stream, or nil if the stream has none.
+// Streams written by older versions, or by something other than njs-xfer, will not.
+func LookupMeta(js nats.JetStreamContext, si *nats.StreamInfo) (*Meta, error) {
+	if si.State.Msgs == 0 {
+		return nil, nil
+	}
+	m, err := js.GetMsg(si.Config.Name, si.State.LastSeq)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMeta(m.Header)
+}
+
+// LookupRef returns the stream and metadata a reference refers to.
+func LookupRef(js nats.JetStreamContext, tm *Meta) (*nats.StreamInfo, *Meta, error) {
+	si, err := LookupStream(js, tm.Ref)
+	if err != nil {
+		return nil, tm, err
+	}
+	rtm, err := LookupMeta(js, si)
+	if err != nil {
+		return nil, tm, err
+	}
+	// References are never chained, and must still match.
+	if rtm == nil || rtm.Ref != "" || rtm.Digest != tm.Digest {
+		return nil, tm, errors.New("referenced stream does not hold the same contents")
+	}
+	return si, rtm, nil
+}
+
+// InProgress reports whether the stream is from a put that is still following
+// its source file and has not yet written its trailer.
+func InProgress(js nats.JetStreamContext, si *nats.StreamInfo) (bool, error) {
+	if si.State.Msgs == 0 {
+		return false, nil
+	}
+	m, err := js.GetMsg(si.Config.Name, si.State.FirstSeq)
+	if err != nil {
+		return false, err
+	}
+	return m.Header.Get(HeaderLive) != "", nil
+}
@@ -0,0 +1,59 @@
+package xfer
+
+import "time"
+
+// A wait for a chunk longer than recvStallThreshold is a stall, such as the
+// server being held back by flow control, rather than the time it takes for
+// the next chunk to be delivered. Peak throughput is measured over intervals
+// of peakInterval.
+const (
+	recvStallThreshold = 50 * time.Millisecond
+	peakInterval       = 250 * time.Millisecond
+)
+
+// recvMeter tells the time spent receiving chunks apart from the time spent
+// stalled waiting for them, and tracks the peak rate they arrive at.
+type recvMeter struct {
+	stalled time.Duration
+	// Start of the current interval, and the bytes received in it.
+	interval time.Time
+	bytes    int64
+	peak     float64
+	// Overall bytes and when the first chunk arrived.
+	total int64
+	first time.Time
+}
+
+// waited records how long we waited for a chunk that arrived.
+func (rm *recvMeter) waited(d time.Duration) {
+	if d > recvStallThreshold {
+		rm.stalled += d
+	}
+}
+
+// add records the arrival of a chunk of n bytes.
+func (rm *recvMeter) add(n int) {
+	now := time.Now()
+	if rm.first.IsZero() {
+		rm.first, rm.interval = now, now
+	}
+	rm.bytes += int64(n)
+	rm.total += int64(n)
+	if d := now.Sub(rm.interval); d >= peakInterval {
+		if rate := float64(rm.bytes) / d.Seconds(); rate > rm.peak {
+			rm.peak = rate
+		}
+		rm.interval, rm.bytes = now, 0
+	}
+}
+
+// report sets the stalled time and peak rate of the result. A transfer too
+// short to fill an interval peaks at its overall rate.
+func (rm *recvMeter) report(res *Result) {
+	res.Stalled = rm.stalled
+	peak := rm.peak
+	if d := time.Since(rm.first); peak == 0 && !rm.first.IsZero() && d > 0 {
+		peak = float64(rm.total) / d.Seconds()
+	}
+	res.PeakRate = int64(peak)
+}
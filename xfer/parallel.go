@@ -0,0 +1,354 @@
+package xfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxRegions limits PutOptions.Parallel, since the trailer records the
+// digest of every region.
+const maxRegions = 64
+
+// parallelSource is a file a parallel put can read the regions of at once.
+type parallelSource interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// regionSubject is the subject the chunks of region i are published on, for
+// a parallel transfer whose stream has the subjects below base. The trailer
+// is published on metaSubject.
+func regionSubject(base string, i int) string {
+	return fmt.Sprintf("%s.region.%d", base, i)
+}
+
+func metaSubject(base string) string {
+	return base + ".meta"
+}
+
+// IsParallel reports whether the stream was created for a parallel put, see
+// PutOptions.Parallel, whether or not the put completed. Its chunks are not
+// in the order of the file.
+func IsParallel(si *nats.StreamInfo) bool {
+	subjects := si.Config.Subjects
+	return len(subjects) == 1 && strings.HasSuffix(subjects[0], ".>")
+}
+
+// parallelBase returns the subject the region subjects of a parallel
+// transfer's stream are below.
+func parallelBase(si *nats.StreamInfo) string {
+	return strings.TrimSuffix(si.Config.Subjects[0], ".>")
+}
+
+// putParallel stores the file in regions at once, see PutOptions.Parallel.
+// Each region is published by a putter of its own, with its own window, and
+// the trailer, recording the layout, follows once all of them are stored.
+func putParallel(ctx context.Context, js nats.JetStreamContext, f parallelSource, fi os.FileInfo, opts PutOptions) (*Result, error) {
+	if opts.Parallel > maxRegions {
+		return nil, fmt.Errorf("can not put in more than %d regions", maxRegions)
+	}
+	p, err := newPutter(ctx, js, &opts)
+	if err != nil {
+		return nil, err
+	}
+	size, cs := fi.Size(), int64(opts.ChunkSize)
+	chunks := int((size + cs - 1) / cs)
+	per := (chunks + opts.Parallel - 1) / opts.Parallel
+	regions := (chunks + per - 1) / per
+
+	base := p.subj
+	p.subj = metaSubject(base)
+	p.pr = newProgressReporter(opts.Progress, 0, size)
+	// Message ids are by position, and the trailer comes after the chunks.
+	p.before = uint64(chunks)
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rps := make([]*putter, regions)
+	digests := make([]string, regions)
+	errs := make([]error, regions)
+	var wg sync.WaitGroup
+	for i := range rps {
+		rp := p.region(rctx, i*per, regionSubject(base, i), regions)
+		rps[i] = rp
+		off := int64(i*per) * cs
+		n := int64(per) * cs
+		if off+n > size {
+			n = size - off
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			digest, err := rp.sendFile(io.NewSectionReader(f, off, n), opts.Name, chunks)
+			if err == nil {
+				err = rp.fc.drain(publishCompleteTimeout)
+			}
+			if err != nil {
+				errs[i] = err
+				cancel()
+			}
+			digests[i] = digest
+		}(i)
+	}
+	// The digest of the whole file is read alongside.
+	var digest string
+	var derr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h := sha256.New()
+		if _, derr = io.Copy(h, io.NewSectionReader(f, 0, size)); derr == nil {
+			digest = hex.EncodeToString(h.Sum(nil))
+		}
+	}()
+	wg.Wait()
+	if err := firstError(ctx, errs); err != nil {
+		return nil, err
+	}
+	if derr != nil {
+		return nil, fmt.Errorf("error reading %q: %v", opts.Name, derr)
+	}
+
+	window := 0
+	for _, rp := range rps {
+		p.res.Bytes += rp.res.Bytes
+		p.fc.dups += rp.fc.dups
+		window += rp.fc.window
+	}
+	if p.res.Bytes != size {
+		return nil, fmt.Errorf("%q changed size during the transfer", opts.Name)
+	}
+	p.index, p.contentType = chunks, rps[0].contentType
+	tm := &Meta{Name: opts.Name, Digest: digest, RegionChunks: per, RegionDigests: digests}
+	p.describe(tm, fi)
+	res, err := p.finish(tm)
+	if res != nil && opts.AdaptiveFlow {
+		res.Window = window
+	}
+	return res, err
+}
+
+// region returns a putter for the region of a parallel put starting at chunk
+// index first, publishing on subj alongside p. It shares p's stream, cipher
+// and progress, with a window and a share of the rate of its own.
+func (p *putter) region(ctx context.Context, first int, subj string, regions int) *putter {
+	rp := &putter{
+		ctx:       ctx,
+		js:        p.js,
+		opts:      p.opts,
+		subj:      subj,
+		start:     p.start,
+		aead:      p.aead,
+		salt:      p.salt,
+		index:     first,
+		before:    uint64(first),
+		pr:        p.pr,
+		unordered: true,
+	}
+	if p.opts.Rate > 0 {
+		rp.lim = newLimiter(p.opts.Rate/int64(regions) + 1)
+	}
+	rp.fc = newFlowController(ctx, p.opts.AdaptiveFlow, func(format string, args ...interface{}) {
+		logf(p.opts.Statusf, format, args...)
+	})
+	if p.opts.Retries > 0 {
+		rp.fc.retry = rp.retry
+	}
+	return rp
+}
+
+// firstError returns the error that stopped the regions of a parallel
+// transfer, rather than the cancellations it caused, or ctx's own.
+func firstError(ctx context.Context, errs []error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var canceled error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		} else if err != nil {
+			canceled = err
+		}
+	}
+	return canceled
+}
+
+// getParallel retrieves the regions of a parallel transfer at once, each
+// with a consumer of its own, writing every chunk at its offset. Each region
+// is checked against its own digest.
+func getParallel(ctx context.Context, js nats.JetStreamContext, si *nats.StreamInfo, tm *Meta, w io.Writer, opts GetOptions, verify string) (*Result, error) {
+	stream := si.Config.Name
+	wa, ok := w.(io.WriterAt)
+	if !ok {
+		return nil, fmt.Errorf("stream %q holds a parallel transfer, which requires a destination that can be written at an offset", stream)
+	}
+	base := parallelBase(si)
+	cs := int64(tm.ChunkSize)
+	chunks := int((tm.Size + cs - 1) / cs)
+	per, regions := tm.RegionChunks, len(tm.RegionDigests)
+	if (chunks+per-1)/per != regions {
+		return nil, integrityErrorf("metadata of %q describes %d regions of %d chunks, but the file has %d chunks", stream, regions, per, chunks)
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr := newProgressReporter(opts.Progress, 0, tm.Size)
+	// Chunks arrive on several go routines, but OnChunk need not know.
+	var mu sync.Mutex
+	onChunk := func(seq uint64) {
+		if opts.OnChunk != nil {
+			mu.Lock()
+			opts.OnChunk(seq)
+			mu.Unlock()
+		}
+	}
+	meters := make([]recvMeter, regions)
+	bytes := make([]int64, regions)
+	errs := make([]error, regions)
+	var wg sync.WaitGroup
+	for i := 0; i < regions; i++ {
+		first, count := i*per, per
+		if first+count > chunks {
+			count = chunks - first
+		}
+		r := &regionGetter{
+			js:      js,
+			stream:  stream,
+			subj:    regionSubject(base, i),
+			first:   first,
+			count:   count,
+			digest:  tm.RegionDigests[i],
+			cs:      cs,
+			w:       wa,
+			dec:     NewDecrypter(opts.Passphrase),
+			pr:      pr,
+			rm:      &meters[i],
+			onChunk: onChunk,
+			opts:    &opts,
+			verify:  verify,
+		}
+		if opts.Rate > 0 {
+			r.lim = newLimiter(opts.Rate/int64(regions) + 1)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if bytes[i], errs[i] = r.get(rctx); errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := firstError(ctx, errs); err != nil {
+		return nil, err
+	}
+
+	// Regions arrive side by side, so their peaks add up while the stalls
+	// of the slowest one are what held the transfer up.
+	res := &Result{Stream: stream, Chunks: chunks, Meta: tm}
+	for i := range meters {
+		res.Bytes += bytes[i]
+		var rr Result
+		meters[i].report(&rr)
+		res.PeakRate += rr.PeakRate
+		if rr.Stalled > res.Stalled {
+			res.Stalled = rr.Stalled
+		}
+	}
+	if verify != VerifyNone && res.Bytes != tm.Size {
+		return nil, integrityErrorf("size mismatch for %q, expected %d bytes but got %d", stream, tm.Size, res.Bytes)
+	}
+	pr.finish()
+	return res, nil
+}
+
+// regionGetter retrieves one region of a parallel transfer.
+type regionGetter struct {
+	js           nats.JetStreamContext
+	stream, subj string
+	first, count int
+	digest       string
+	cs           int64
+	w            io.WriterAt
+	dec          *Decrypter
+	lim          *limiter
+	pr           *progressReporter
+	rm           *recvMeter
+	onChunk      func(seq uint64)
+	opts         *GetOptions
+	verify       string
+}
+
+// get retrieves the region, returning the number of bytes written.
+func (r *regionGetter) get(ctx context.Context) (int64, error) {
+	sub, err := r.js.SubscribeSync(r.subj,
+		nats.BindStream(r.stream),
+		nats.AckNone(),
+		nats.DeliverAll(),
+		nats.EnableFlowControl(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error creating consumer: %v", err)
+	}
+	defer sub.Unsubscribe()
+	debugConsumer(sub, r.opts.Debugf)
+
+	var dv *digestVerifier
+	if r.verify == VerifyFull {
+		dv = newDigestVerifier()
+	}
+	var bytes int64
+	for next := r.first; next < r.first+r.count; next++ {
+		start := time.Now()
+		m, err := nextMsg(ctx, sub, recvTimeout(*r.opts, 5*time.Second))
+		if err != nil && ctx.Err() != nil {
+			return 0, ctx.Err()
+		} else if err != nil {
+			return 0, integrityErrorf("region %s of %q incomplete, stopped at chunk %d: %v", r.subj, r.stream, next, err)
+		}
+		r.rm.waited(time.Since(start))
+		r.rm.add(len(m.Data))
+		meta, err := m.Metadata()
+		if err != nil {
+			return 0, err
+		}
+		r.onChunk(meta.Sequence.Stream)
+		if index := HeaderInt(m.Header, HeaderChunkIndex); index != next {
+			return 0, integrityErrorf("missed chunk in %q, expected %d but got %d", r.stream, next, index)
+		}
+		data, err := r.dec.ChunkData(m.Header, m.Data)
+		if err != nil {
+			return 0, integrityErrorf("error reading chunk at sequence %d of %q: %v", meta.Sequence.Stream, r.stream, err)
+		}
+		if err := r.lim.wait(ctx, len(data)); err != nil {
+			return 0, err
+		}
+		if _, err := r.w.WriteAt(data, int64(next)*r.cs); err != nil {
+			return 0, fmt.Errorf("error writing chunk %d: %v", next, err)
+		}
+		logf(r.opts.Debugf, "Received chunk %d at sequence %d, %d bytes", next, meta.Sequence.Stream, len(data))
+		bytes += int64(len(data))
+		r.pr.add(len(data))
+		if dv != nil {
+			dv.add(data)
+		}
+	}
+	if dv != nil {
+		if sum := dv.sum(); sum != r.digest {
+			return 0, integrityErrorf("checksum mismatch for %q, expected SHA-256 %s for chunks %d-%d but got %s, retrieved file is corrupt",
+				r.stream, r.digest, r.first, r.first+r.count-1, sum)
+		}
+	}
+	return bytes, nil
+}
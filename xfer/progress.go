@@ -0,0 +1,58 @@
+package xfer
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressFunc is called with the bytes transferred so far and the total,
+// or -1 for a total that is not known up front, e.g. when putting from
+// stdin or following. When resuming, bytes includes what was retrieved
+// before.
+type ProgressFunc func(bytes, total int64)
+
+// ProgressInterval is the most often a ProgressFunc is called while a
+// transfer is running. It is called once more when the transfer completes,
+// with the final count, but not when it fails. Calls are never concurrent.
+const ProgressInterval = 100 * time.Millisecond
+
+// progressReporter throttles the calls to a ProgressFunc. A nil one does
+// nothing.
+type progressReporter struct {
+	mu    sync.Mutex
+	f     ProgressFunc
+	bytes int64
+	total int64
+	last  time.Time
+}
+
+func newProgressReporter(f ProgressFunc, bytes, total int64) *progressReporter {
+	if f == nil {
+		return nil
+	}
+	return &progressReporter{f: f, bytes: bytes, total: total, last: time.Now()}
+}
+
+// add records n more bytes, reporting them if it is time to.
+func (pr *progressReporter) add(n int) {
+	if pr == nil {
+		return
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.bytes += int64(n)
+	if now := time.Now(); now.Sub(pr.last) >= ProgressInterval {
+		pr.last = now
+		pr.f(pr.bytes, pr.total)
+	}
+}
+
+// finish reports the final count.
+func (pr *progressReporter) finish() {
+	if pr == nil {
+		return
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.f(pr.bytes, pr.total)
+}
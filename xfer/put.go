@@ -0,0 +1,653 @@
+package xfer
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Define our chunk size to be 64k. Important not to make this too big, NATS likes smaller messages
+// and is plenty fast to transfer at very high rates even with smaller payloads.
+const DefaultChunkSize = 64 * 1024
+
+// ChunkHeaderRoom is what we leave for our headers below the server's maximum
+// payload, so each chunk fits in a message along with them.
+const ChunkHeaderRoom = 4 * 1024
+
+// ErrChunkTooBig is returned when a chunk would not fit in the server's
+// maximum payload.
+var ErrChunkTooBig = errors.New("chunk size too big")
+
+// CheckChunkSize checks that chunks of chunkSize, along with their headers,
+// fit within the maximum payload once compressed or encrypted, which can
+// make them a little bigger.
+func CheckChunkSize(chunkSize int, maxPayload int64, compress, encrypt bool) error {
+	room := int64(ChunkHeaderRoom)
+	if compress {
+		// Data that does not compress is stored in blocks of up to 64KB,
+		// each with 5 bytes of overhead, plus 18 bytes for gzip itself.
+		room += 5*(int64(chunkSize)/0xffff+1) + 18
+	}
+	if encrypt {
+		// The nonce and the tag.
+		room += 12 + 16
+	}
+	if int64(chunkSize)+room > maxPayload {
+		return fmt.Errorf("%w: %d bytes, the server's maximum payload of %d bytes leaves room for chunks of at most %d bytes",
+			ErrChunkTooBig, chunkSize, maxPayload, maxPayload-room)
+	}
+	return nil
+}
+
+// retryBackoff is how long we wait before resending a chunk the first time,
+// doubling for each retry up to maxRetryBackoff.
+const (
+	retryBackoff    = 250 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// dedupWindow is how long the server remembers the message ids of our
+// chunks, within which a chunk published again is discarded as a duplicate.
+const dedupWindow = 2 * time.Minute
+
+// publishCompleteTimeout is how long Put waits for the last of its
+// chunks to be acknowledged once they have all been sent.
+const publishCompleteTimeout = 30 * time.Second
+
+// PutOptions control how Put and PutDir store a transfer.
+type PutOptions struct {
+	// Stream to create for the transfer.
+	Stream string
+	// Subject for the stream, a new inbox if empty.
+	Subject string
+	// Name of the file, recorded in the metadata.
+	Name string
+	// Size of the chunks, DefaultChunkSize if 0.
+	ChunkSize int
+	// The server's maximum payload, checked against the chunk size before
+	// the stream is created, 0 not to check.
+	MaxPayload int64
+	// Compress all files, or those with these lower cased extensions, e.g. ".txt".
+	Compress     bool
+	CompressExts []string
+	// If not nil, keep reading as the source grows, like tail -f, until it is closed.
+	Follow <-chan struct{}
+	// Experimental: split the file into this many regions of consecutive
+	// chunks, if more than 1, and publish them at once, each on its own
+	// subject in the stream. The source must be a regular file that can be
+	// read at an offset, such as an *os.File, and can not be followed or
+	// appended to. Get writes the regions at their offsets, so it needs a
+	// destination that can be written at an offset too.
+	Parallel int
+	// Encrypt the chunks with a key derived from this passphrase, if set.
+	Passphrase string
+	// Maximum rate to send at in bytes per second, 0 for no limit.
+	Rate int64
+	// Number of times to resend a chunk that failed with a transient error,
+	// such as a timeout or no responders, 0 to fail straight away.
+	Retries int
+	// Adapt the publish window to how fast the server acknowledges chunks.
+	AdaptiveFlow bool
+	// Where the stream should be placed in a clustered JetStream, nil for anywhere.
+	Placement *nats.Placement
+	// Number of replicas for the stream, 1 if 0.
+	Replicas int
+	// Storage for the stream, file storage unless set to nats.MemoryStorage.
+	Storage nats.StorageType
+	// Maximum age of the stream's chunks, after which they expire, 0 for none.
+	MaxAge time.Duration
+	// Use the stream if it already exists, as long as it is empty.
+	AllowExisting bool
+	// Continue an interrupted Put of the same file in the existing stream,
+	// skipping the chunks it already holds. Without a stream we start afresh.
+	Append bool
+	// Wait for all replicas to be current before returning.
+	WaitDurable bool
+	// Include the targets of symbolic links in PutDir.
+	FollowSymlinks bool
+	// Store files in PutDir with the same contents as an earlier one as
+	// entries referring to it, without their chunks.
+	Dedup bool
+	// Progress, if set, is called with how much has been sent, at most
+	// every ProgressInterval.
+	Progress ProgressFunc
+	// Logf and Statusf, if set, report events worth keeping, such as warnings,
+	// and transient ones, such as a shrinking publish window.
+	Logf    func(format string, args ...interface{})
+	Statusf func(format string, args ...interface{})
+	// Debugf, if set, reports detail, such as the configuration of the
+	// stream and every chunk sent.
+	Debugf func(format string, args ...interface{})
+}
+
+// Result describes a completed Put or Get.
+type Result struct {
+	// Stream holding the contents, which for a reference is not the one asked for.
+	Stream string
+	// Bytes and Chunks transferred, and Files for a directory.
+	Bytes  int64
+	Chunks int
+	Files  int
+	// Gaps in the chunk sequence that Get recovered from.
+	Gaps int
+	// Window is the publish window, in chunks, Put settled on with AdaptiveFlow.
+	Window int
+	// Stalled is how long Get spent waiting on chunks that were held back,
+	// e.g. by flow control, and PeakRate the fastest chunks arrived at, in
+	// bytes per second.
+	Stalled  time.Duration
+	PeakRate int64
+	// Meta is the transfer's metadata, nil if a stream Get read has none.
+	Meta *Meta
+}
+
+func logf(f func(format string, args ...interface{}), format string, args ...interface{}) {
+	if f != nil {
+		f(format, args...)
+	}
+}
+
+// putter publishes the messages of a transfer into its stream.
+type putter struct {
+	ctx  context.Context
+	js   nats.JetStreamContext
+	opts *PutOptions
+	subj string
+	fc   *flowController
+	lim  *limiter
+	res  Result
+	// When we started, to know whether our first chunks may have expired.
+	start time.Time
+	// Cipher for encrypting chunks, and the salt its key was derived with.
+	aead  cipher.AEAD
+	salt  string
+	index int
+	// Chunks already in the stream when appending, which are not sent again.
+	skip  int
+	total int
+	// Messages in the stream before we started, and that we have published.
+	before, published uint64
+	// MIME type detected from the first chunk.
+	contentType string
+	pr          *progressReporter
+	// unordered is set for the regions of a parallel put, whose chunks
+	// are placed by their index rather than their order in the stream.
+	unordered bool
+}
+
+// newPutter creates the stream for a transfer, or checks the existing one.
+func newPutter(ctx context.Context, js nats.JetStreamContext, opts *PutOptions) (*putter, error) {
+	if opts.Stream == "" || opts.Name == "" {
+		return nil, errors.New("a stream and name are needed")
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.Replicas <= 0 {
+		opts.Replicas = 1
+	}
+	if opts.MaxPayload > 0 {
+		compress := opts.Compress || len(opts.CompressExts) > 0
+		if err := CheckChunkSize(opts.ChunkSize, opts.MaxPayload, compress, opts.Passphrase != ""); err != nil {
+			return nil, err
+		}
+	}
+	p := &putter{ctx: ctx, js: js, opts: opts, subj: opts.Subject, start: time.Now()}
+	p.res.Stream = opts.Stream
+	p.lim = newLimiter(opts.Rate)
+	p.fc = newFlowController(ctx, opts.AdaptiveFlow, func(format string, args ...interface{}) {
+		logf(opts.Statusf, format, args...)
+	})
+	if opts.Retries > 0 {
+		p.fc.retry = p.retry
+	}
+	// Delivery subject as an inbox to avoid accidentally interfering with other subjects.
+	// Either way the stream's config records it for get.
+	if p.subj == "" {
+		p.subj = nats.NewInbox()
+	}
+
+	if opts.Passphrase != "" {
+		var err error
+		if p.salt, err = newSalt(); err != nil {
+			return nil, fmt.Errorf("error creating salt: %v", err)
+		}
+		if p.aead, err = newCipher(opts.Passphrase, p.salt); err != nil {
+			return nil, fmt.Errorf("error deriving key: %v", err)
+		}
+	}
+
+	// Create our stream, or use one that was created for us.
+	if existing, err := js.StreamInfo(opts.Stream); err == nil && opts.Append {
+		if err := p.appendTo(existing); err != nil {
+			return nil, err
+		}
+		return p, nil
+	} else if err == nil {
+		if !opts.AllowExisting {
+			return nil, fmt.Errorf("stream %q %w", opts.Stream, ErrExists)
+		}
+		if err := checkExistingStream(existing, opts.ChunkSize); err != nil {
+			return nil, err
+		}
+		p.subj = existing.Config.Subjects[0]
+		p.fc.lastSeq, p.before = existing.State.LastSeq, existing.State.Msgs
+		return p, nil
+	}
+	subjects := []string{p.subj}
+	if opts.Parallel > 1 {
+		// Each region has a subject of its own, see regionSubject.
+		subjects = []string{p.subj + ".>"}
+	}
+	si, err := js.AddStream(&nats.StreamConfig{
+		Name:       opts.Stream,
+		Subjects:   subjects,
+		Placement:  opts.Placement,
+		Replicas:   opts.Replicas,
+		Storage:    opts.Storage,
+		MaxAge:     opts.MaxAge,
+		Duplicates: dedupWindow,
+	})
+	if err != nil && opts.Replicas > 1 {
+		return nil, fmt.Errorf("error creating stream with %d replicas, JetStream may not be clustered or have enough servers: %v", opts.Replicas, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("unexpected error creating stream: %v", err)
+	}
+	logf(opts.Debugf, "Created stream %q with %s", opts.Stream, configJSON(si.Config))
+	if opts.Placement != nil {
+		logf(opts.Logf, "%s", placementInfo(si))
+	}
+	if opts.Storage == nats.MemoryStorage {
+		if opts.Replicas > 1 {
+			logf(opts.Logf, "Warning: stream %q is kept in memory, it is lost if all of its servers restart", opts.Stream)
+		} else {
+			logf(opts.Logf, "Warning: stream %q is kept in memory, it is lost if the server restarts", opts.Stream)
+		}
+	}
+	// A server that is not clustered accepts but ignores replicas.
+	if opts.Replicas > 1 && (si.Cluster == nil || si.Cluster.Name == "") {
+		logf(opts.Logf, "Warning: JetStream is not clustered, stream %q has no replicas", opts.Stream)
+	}
+	return p, nil
+}
+
+// appendTo sets us up to continue the interrupted transfer in the existing
+// stream. It has to be one of ours without a trailer, and its chunks must
+// all be there and have our chunk size. Encrypted chunks carry on with the
+// same salt, so the whole transfer has one key.
+func (p *putter) appendTo(si *nats.StreamInfo) error {
+	stream := si.Config.Name
+	if IsParallel(si) {
+		return fmt.Errorf("stream %q is from a parallel put, it can not be appended to", stream)
+	}
+	if si.State.Msgs == 0 {
+		p.subj = si.Config.Subjects[0]
+		p.fc.lastSeq = si.State.LastSeq
+		return nil
+	}
+	m, err := p.js.GetMsg(stream, si.State.LastSeq)
+	if err != nil {
+		return fmt.Errorf("error reading stream %q: %v", stream, err)
+	}
+	switch index := HeaderInt(m.Header, HeaderChunkIndex); {
+	case m.Header.Get(HeaderMeta) != "":
+		return fmt.Errorf("stream %q holds a complete transfer, there is nothing to append", stream)
+	case m.Header.Get(HeaderEntry) != "" || index < 0:
+		return fmt.Errorf("stream %q does not end with a chunk of a file, it can not be appended to", stream)
+	case uint64(index+1) != si.State.Msgs:
+		return fmt.Errorf("stream %q is missing chunks, it can not be appended to", stream)
+	case HeaderInt(m.Header, HeaderChunkSize) != p.opts.ChunkSize:
+		return fmt.Errorf("stream %q was written with a chunk size of %d, not %d", stream, HeaderInt(m.Header, HeaderChunkSize), p.opts.ChunkSize)
+	case (m.Header.Get(HeaderEncryption) != "") != (p.opts.Passphrase != ""):
+		return fmt.Errorf("stream %q must be appended to with the same encryption", stream)
+	default:
+		p.skip = index + 1
+		p.total = HeaderInt(m.Header, HeaderChunkTotal)
+	}
+	if p.aead != nil {
+		salt := m.Header.Get(HeaderSalt)
+		aead, err := newCipher(p.opts.Passphrase, salt)
+		if err != nil {
+			return fmt.Errorf("error deriving key: %v", err)
+		}
+		p.aead, p.salt = aead, salt
+	}
+	p.subj = si.Config.Subjects[0]
+	p.fc.lastSeq, p.before = si.State.LastSeq, si.State.Msgs
+	logf(p.opts.Logf, "Appending to stream %q after its %d chunks", stream, p.skip)
+	return nil
+}
+
+// publish sends a message, keeping within our window.
+// Once our context is done we stop with its error.
+func (p *putter) publish(m *nats.Msg) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.fc.wait(); err != nil {
+		return err
+	}
+	// The server discards a message whose id it has already stored, so a
+	// chunk that is published again is only stored once.
+	m.Header.Set(nats.MsgIdHdr, msgID(p.before+p.published, m.Data))
+	p.published++
+	for attempt := 0; ; attempt++ {
+		paf, err := p.js.PublishMsgAsync(m)
+		if err == nil {
+			p.fc.add(paf)
+			return nil
+		}
+		if !isTransient(err) || attempt >= p.opts.Retries {
+			return fmt.Errorf("error sending chunk to JetStream: %v", err)
+		}
+		logf(p.opts.Statusf, "Error sending chunk to JetStream: %v, retrying (%d of %d)", err, attempt+1, p.opts.Retries)
+		if err := p.backoff(attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// msgID returns the message id for the n-th message of a transfer, from
+// its position and contents.
+func msgID(n uint64, data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d-%x", n, sum[:8])
+}
+
+// backoff waits before a retry, longer for each attempt.
+func (p *putter) backoff(attempt int) error {
+	delay := retryBackoff << uint(attempt)
+	if delay > maxRetryBackoff || delay <= 0 {
+		delay = maxRetryBackoff
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// retry recovers from a chunk that failed with a transient error. The chunks
+// have to be stored in order, so we first wait for the rest of the window,
+// which normally fails along with it, and then resend them one at a time.
+func (p *putter) retry(failed nats.PubAckFuture, err error) error {
+	fc := p.fc
+	msgs := []*nats.Msg{failed.Msg()}
+	for len(fc.pafs) > 0 {
+		paf := fc.pafs[0]
+		fc.pafs = fc.pafs[1:]
+		select {
+		case pa := <-paf.Ok():
+			// This is only in order if the chunks before it were stored
+			// even though we did not hear back about them.
+			if !p.unordered && pa.Sequence != fc.lastSeq+uint64(len(msgs))+1 {
+				return fmt.Errorf("error sending chunk to JetStream: %v, and later chunks were stored, so it can not be resent in order", err)
+			}
+			msgs = nil
+			fc.stored(pa)
+			continue
+		case <-paf.Err():
+		case <-time.After(flowAckTimeout):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		msgs = append(msgs, paf.Msg())
+	}
+	for _, m := range msgs {
+		if err := p.resend(m, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resend publishes a failed chunk again, waiting for it to be stored.
+func (p *putter) resend(m *nats.Msg, err error) error {
+	for attempt := 0; attempt < p.opts.Retries; attempt++ {
+		logf(p.opts.Statusf, "Error sending chunk to JetStream: %v, retrying (%d of %d)", err, attempt+1, p.opts.Retries)
+		if err := p.backoff(attempt); err != nil {
+			return err
+		}
+		// The chunk may have been stored even though we heard nothing back,
+		// in which case the server tells us it is a duplicate.
+		m.Reply = ""
+		pa, perr := p.js.PublishMsg(m)
+		if perr == nil {
+			p.fc.stored(pa)
+			return nil
+		}
+		if !isTransient(perr) {
+			return fmt.Errorf("error sending chunk to JetStream: %v", perr)
+		}
+		err = perr
+	}
+	return fmt.Errorf("error sending chunk to JetStream after %d retries: %v", p.opts.Retries, err)
+}
+
+// checkStored warns if the stream does not hold the messages we published,
+// less any the server discarded as duplicates.
+func (p *putter) checkStored() {
+	if p.fc.dups > 0 {
+		logf(p.opts.Logf, "Server discarded %d duplicate chunks of stream %q", p.fc.dups, p.opts.Stream)
+	}
+	si, err := p.js.StreamInfo(p.opts.Stream)
+	if err != nil {
+		return
+	}
+	if want := p.before + p.published - uint64(p.fc.dups); si.State.Msgs != want {
+		logf(p.opts.Logf, "Warning: stream %q holds %d messages, expected %d", p.opts.Stream, si.State.Msgs, want)
+	}
+}
+
+// sendFile loops and grabs chunks from a file, returning the digest of its
+// contents. Chunk indexes carry on across calls, and total is the number
+// of chunks in the transfer if known.
+// The reads happen in their own go routine so disk I/O overlaps with publishing.
+func (p *putter) sendFile(r io.Reader, name string, total int) (string, error) {
+	opts := p.opts
+	compress := opts.Compress || hasExt(name, opts.CompressExts)
+	cr := newChunkReader(r, opts.ChunkSize, opts.Follow)
+	defer cr.close()
+	for {
+		// A slow source, such as a pipe or a followed file, may keep us
+		// waiting for the next chunk.
+		var chunk []byte
+		var ok bool
+		select {
+		case chunk, ok = <-cr.chunks:
+		case <-p.ctx.Done():
+			return "", p.ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		if p.index == 0 {
+			p.contentType = contentType(name, chunk)
+		}
+		// When appending the chunks already stored are only read, for the digest.
+		if p.index < p.skip {
+			p.res.Bytes += int64(len(chunk))
+			p.pr.add(len(chunk))
+			p.index++
+			cr.recycle(chunk)
+			continue
+		}
+		m := nats.NewMsg(p.subj)
+		m.Data = chunk
+		if compress {
+			var err error
+			if m.Data, err = compressChunk(chunk); err != nil {
+				return "", fmt.Errorf("error compressing chunk: %v", err)
+			}
+			m.Header.Set(HeaderCompression, CompressionGzip)
+		}
+		// Encryption comes last, since encrypted data does not compress.
+		if p.aead != nil {
+			var err error
+			if m.Data, err = encryptChunk(p.aead, m.Data); err != nil {
+				return "", fmt.Errorf("error encrypting chunk: %v", err)
+			}
+			m.Header.Set(HeaderEncryption, EncryptionAESGCM)
+			m.Header.Set(HeaderSalt, p.salt)
+		}
+		// The chunk's buffer is read into again once recycled, while a chunk
+		// that has to be resent is taken from its message, so the message
+		// needs data of its own.
+		if !compress && p.aead == nil {
+			m.Data = append([]byte(nil), chunk...)
+		}
+		// Pace what we send, which also keeps the publish window from filling.
+		if err := p.lim.wait(p.ctx, len(m.Data)); err != nil {
+			return "", err
+		}
+		// Make the chunk self describing.
+		m.Header.Set(HeaderChunkIndex, strconv.Itoa(p.index))
+		m.Header.Set(HeaderChunkSize, strconv.Itoa(opts.ChunkSize))
+		if total >= 0 {
+			m.Header.Set(HeaderChunkTotal, strconv.Itoa(total))
+		}
+		setChunkCRC(m.Header, m.Data)
+		// Mark the stream as in progress while following.
+		if opts.Follow != nil {
+			m.Header.Set(HeaderLive, "true")
+		}
+		if err := p.publish(m); err != nil {
+			return "", err
+		}
+		logf(opts.Debugf, "Sent chunk %d, %d bytes", p.index, len(m.Data))
+		p.res.Bytes += int64(len(chunk))
+		p.index++
+		p.pr.add(len(chunk))
+		cr.recycle(chunk)
+	}
+	if cr.err != nil {
+		return "", fmt.Errorf("error reading %q: %v", name, cr.err)
+	}
+	return cr.digest(), nil
+}
+
+// finish writes the trailer and waits for everything to be stored.
+func (p *putter) finish(tm *Meta) (*Result, error) {
+	tm.ChunkSize = p.opts.ChunkSize
+	tm.Size = p.res.Bytes
+	if p.aead != nil {
+		tm.Encryption, tm.Salt = EncryptionAESGCM, p.salt
+	}
+	// Our first chunks are gone if we took longer than they are kept.
+	if p.opts.MaxAge > 0 && time.Since(p.start) >= p.opts.MaxAge {
+		return nil, fmt.Errorf("transfer took longer than the stream's maximum age of %v, its first chunks have expired", p.opts.MaxAge)
+	}
+	// Get will read until it sees this message.
+	tm.Completion = CompletionTrailer
+	mm := nats.NewMsg(p.subj)
+	mm.Header = tm.Header()
+	if err := p.publish(mm); err != nil {
+		return nil, fmt.Errorf("error sending metadata to JetStream: %v", err)
+	}
+	// Nothing is stored until it has been acknowledged.
+	if err := p.fc.drain(publishCompleteTimeout); err != nil {
+		return nil, err
+	}
+	p.checkStored()
+	if p.opts.WaitDurable {
+		if err := waitForReplicas(p.js, p.opts.Stream); err != nil {
+			return nil, err
+		}
+	}
+	p.res.Chunks, p.res.Meta = p.index, tm
+	if p.opts.AdaptiveFlow {
+		p.res.Window = p.fc.window
+	}
+	p.pr.finish()
+	return &p.res, nil
+}
+
+// Put reads r to the end and stores it in a new stream as a transfer named
+// opts.Name. If r is a regular file, such as an *os.File, its modification
+// time is recorded, and unless following its size is used to record the
+// number of chunks. Otherwise, e.g. for a pipe, we only learn the size when
+// we reach the end, and get relies on the trailer.
+// If ctx is done before the transfer completes Put stops and returns its
+// error, leaving what was sent so far in the stream.
+func Put(ctx context.Context, js nats.JetStreamContext, r io.Reader, opts PutOptions) (*Result, error) {
+	if opts.Parallel > 1 {
+		if opts.Follow != nil || opts.Append || opts.AllowExisting {
+			return nil, errors.New("a parallel put can not follow, append or use an existing stream")
+		}
+		ra, ok := r.(parallelSource)
+		if !ok {
+			return nil, errors.New("a parallel put needs a file that can be read at an offset")
+		}
+		fi, err := ra.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, errors.New("a parallel put needs a regular file")
+		}
+		// A file of a single chunk has nothing to split.
+		if opts.ChunkSize <= 0 {
+			opts.ChunkSize = DefaultChunkSize
+		}
+		if fi.Size() > int64(opts.ChunkSize) {
+			return putParallel(ctx, js, ra, fi, opts)
+		}
+		opts.Parallel = 0
+	}
+	p, err := newPutter(ctx, js, &opts)
+	if err != nil {
+		return nil, err
+	}
+	st, _ := r.(interface{ Stat() (os.FileInfo, error) })
+	total, size := -1, int64(-1)
+	if st != nil && opts.Follow == nil {
+		if fi, err := st.Stat(); err == nil && fi.Mode().IsRegular() {
+			total = int((fi.Size() + int64(opts.ChunkSize) - 1) / int64(opts.ChunkSize))
+			size = fi.Size()
+		}
+	}
+	p.pr = newProgressReporter(opts.Progress, 0, size)
+	if p.skip > 0 && p.total >= 0 && total >= 0 && p.total != total {
+		return nil, fmt.Errorf("%q is not the file that was being put into stream %q, its size differs", opts.Name, opts.Stream)
+	}
+	if p.skip > 0 && total >= 0 && p.skip > total {
+		return nil, fmt.Errorf("%q is smaller than what stream %q already holds", opts.Name, opts.Stream)
+	}
+
+	// Our metadata will be the last message in the stream.
+	tm := &Meta{Name: opts.Name}
+	if tm.Digest, err = p.sendFile(r, opts.Name, total); err != nil {
+		return nil, err
+	}
+	if total >= 0 && p.index != total {
+		return nil, fmt.Errorf("%q changed size during the transfer", opts.Name)
+	}
+	// The file may have grown while following, so check its time now.
+	var fi os.FileInfo
+	if st != nil {
+		fi, _ = st.Stat()
+	}
+	p.describe(tm, fi)
+	return p.finish(tm)
+}
+
+// describe completes the metadata of a file that has been sent, with its
+// time and mode taken from fi if it is a regular file.
+func (p *putter) describe(tm *Meta, fi os.FileInfo) {
+	if p.opts.Compress || hasExt(p.opts.Name, p.opts.CompressExts) {
+		tm.Compression = CompressionGzip
+	}
+	// An empty file has no chunk to detect its type from.
+	if tm.ContentType = p.contentType; tm.ContentType == "" {
+		tm.ContentType = contentType(p.opts.Name, nil)
+	}
+	if fi != nil && fi.Mode().IsRegular() {
+		tm.ModTime, tm.Mode = fi.ModTime(), fi.Mode().Perm()
+	}
+}
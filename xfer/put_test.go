@@ -0,0 +1,182 @@
+package xfer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// lossyJS drops the asynchronous publishes with the given numbers, counting
+// from 0, failing them with a timeout as if the server never answered.
+type lossyJS struct {
+	nats.JetStreamContext
+	mu   sync.Mutex
+	n    int
+	lose map[int]bool
+}
+
+func (l *lossyJS) PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	l.mu.Lock()
+	n := l.n
+	l.n++
+	l.mu.Unlock()
+	if !l.lose[n] {
+		return l.JetStreamContext.PublishMsgAsync(m, opts...)
+	}
+	la := &lostAck{m: m, err: make(chan error, 1)}
+	la.err <- nats.ErrTimeout
+	return la, nil
+}
+
+// lostAck is the future of a publish that never reached the server.
+type lostAck struct {
+	m   *nats.Msg
+	err chan error
+}
+
+func (la *lostAck) Ok() <-chan *nats.PubAck { return nil }
+func (la *lostAck) Err() <-chan error       { return la.err }
+func (la *lostAck) Msg() *nats.Msg          { return la.m }
+
+func TestPutResend(t *testing.T) {
+	_, js := runServer(t)
+	// With the default window of 8 chunks, losing chunks 2 to 9 makes Put
+	// resend all of them once the window is full, long after their buffers
+	// were read into again.
+	lose := make(map[int]bool)
+	for i := 2; i < 10; i++ {
+		lose[i] = true
+	}
+	for _, tc := range []struct {
+		name string
+		opts PutOptions
+	}{
+		{"plain", PutOptions{}},
+		{"compressed", PutOptions{Compress: true}},
+		{"encrypted", PutOptions{Passphrase: "secret"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, data := randomFile(t, tc.name+".bin", 20*1024)
+			tc.opts.ChunkSize, tc.opts.Retries = 1024, 3
+			putFile(t, &lossyJS{JetStreamContext: js, lose: lose}, tc.name, path, tc.opts)
+			got, _ := getBytes(t, js, tc.name, GetOptions{Passphrase: tc.opts.Passphrase})
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+			}
+		})
+	}
+}
+
+// slowJS delays the acknowledgements of the asynchronous publishes with the
+// given numbers, counting from 0, like a server that falls behind.
+type slowJS struct {
+	nats.JetStreamContext
+	mu    sync.Mutex
+	n     int
+	slow  map[int]bool
+	delay time.Duration
+}
+
+func (s *slowJS) PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	s.mu.Lock()
+	n := s.n
+	s.n++
+	s.mu.Unlock()
+	paf, err := s.JetStreamContext.PublishMsgAsync(m, opts...)
+	if err != nil || !s.slow[n] {
+		return paf, err
+	}
+	da := &delayedAck{PubAckFuture: paf, ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	go func() {
+		select {
+		case pa := <-paf.Ok():
+			time.Sleep(s.delay)
+			da.ok <- pa
+		case err := <-paf.Err():
+			da.err <- err
+		}
+	}()
+	return da, nil
+}
+
+// delayedAck is the future of a publish whose acknowledgement is held back.
+type delayedAck struct {
+	nats.PubAckFuture
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func (da *delayedAck) Ok() <-chan *nats.PubAck { return da.ok }
+func (da *delayedAck) Err() <-chan error       { return da.err }
+
+func TestAdaptiveFlow(t *testing.T) {
+	_, js := runServer(t)
+	path, data := randomFile(t, "adaptive.bin", 300*1024)
+	// The server stalls once the window has had time to grow, and then
+	// catches up again.
+	slow := make(map[int]bool)
+	for i := 60; i < 64; i++ {
+		slow[i] = true
+	}
+	var mu sync.Mutex
+	var reduced []int
+	opts := PutOptions{ChunkSize: 1024, AdaptiveFlow: true}
+	opts.Statusf = func(format string, args ...interface{}) {
+		var window int
+		if _, err := fmt.Sscanf(fmt.Sprintf(format, args...), "Server is not keeping up, reduced publish window to %d chunks", &window); err == nil {
+			mu.Lock()
+			reduced = append(reduced, window)
+			mu.Unlock()
+		}
+	}
+	res := putFile(t, &slowJS{JetStreamContext: js, slow: slow, delay: 3 * flowStallThreshold / 2}, "adaptive", path, opts)
+
+	if len(reduced) == 0 {
+		t.Fatalf("The publish window was never reduced")
+	}
+	// It had grown past where it started before it was halved.
+	if reduced[0] < startAdaptiveWindow {
+		t.Fatalf("Window was reduced to %d, expected it to have grown first", reduced[0])
+	}
+	// And grows again once the server keeps up.
+	if low := reduced[len(reduced)-1]; res.Window <= low {
+		t.Fatalf("Window settled on %d, expected it to recover from %d", res.Window, low)
+	}
+	got, _ := getBytes(t, js, "adaptive", GetOptions{})
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+	}
+}
+
+// BenchmarkPut compares reading chunks ahead of the publisher with reading
+// and publishing them in turn.
+func BenchmarkPut(b *testing.B) {
+	_, js := runServer(b)
+	const size = 32 * 1024 * 1024
+	path, _ := randomFile(b, "bench.bin", size)
+	for _, bc := range []struct {
+		name  string
+		depth int
+	}{
+		{"serial", 1},
+		{"pipeline", chunkReaderDepth},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			defer func(depth int) { chunkReaderDepth = depth }(chunkReaderDepth)
+			chunkReaderDepth = bc.depth
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				putFile(b, js, "bench", path, PutOptions{})
+				b.StopTimer()
+				if err := js.DeleteStream("bench"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
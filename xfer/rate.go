@@ -0,0 +1,46 @@
+package xfer
+
+import (
+	"context"
+	"time"
+)
+
+// limiter paces a transfer to a rate in bytes per second with a token bucket.
+// The bucket holds at most a second's worth of bytes, so after a pause we
+// only burst briefly before settling back to the rate.
+type limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter for the rate, or nil for no limit.
+func newLimiter(rate int64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{rate: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n more bytes may be sent, or ctx is done.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(time.Duration(-l.tokens / l.rate * float64(time.Second))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
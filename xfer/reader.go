@@ -0,0 +1,106 @@
+package xfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"time"
+)
+
+// chunkReaderDepth is how many chunks may be read ahead of the publisher.
+// With a depth of one, reads and publishes take turns, as if done serially.
+var chunkReaderDepth = 4
+
+// followPollInterval is how often we check a followed file for new data.
+const followPollInterval = 250 * time.Millisecond
+
+// chunkReader reads chunks from a reader in its own go routine and delivers
+// them in order. A fixed set of buffers is recycled to bound memory usage.
+// It also keeps a running digest as it reads, so the file only needs to be
+// read once. Once chunks is closed err holds any error reading.
+type chunkReader struct {
+	chunks chan []byte
+	free   chan []byte
+	done   chan struct{}
+	h      hash.Hash
+	err    error
+}
+
+// newChunkReader starts reading chunks from r. If follow is not nil we will keep
+// polling for more data at EOF until it is closed, like tail -f.
+func newChunkReader(r io.Reader, chunkSize int, follow <-chan struct{}) *chunkReader {
+	cr := &chunkReader{
+		chunks: make(chan []byte, chunkReaderDepth),
+		free:   make(chan []byte, chunkReaderDepth),
+		done:   make(chan struct{}),
+		h:      sha256.New(),
+	}
+	for i := 0; i < chunkReaderDepth; i++ {
+		cr.free <- make([]byte, chunkSize)
+	}
+	go func() {
+		defer close(cr.chunks)
+		for {
+			var buf []byte
+			select {
+			case buf = <-cr.free:
+			case <-cr.done:
+				return
+			}
+			n, err := readChunk(r, buf, follow)
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				cr.err = err
+				return
+			}
+			cr.h.Write(buf[:n])
+			select {
+			case cr.chunks <- buf[:n]:
+			case <-cr.done:
+				return
+			}
+		}
+	}()
+	return cr
+}
+
+// digest returns the hex encoded SHA-256 digest of everything read.
+// It should only be called once chunks has been closed.
+func (cr *chunkReader) digest() string {
+	return hex.EncodeToString(cr.h.Sum(nil))
+}
+
+// close stops the reader if the caller is done early.
+func (cr *chunkReader) close() {
+	close(cr.done)
+}
+
+// readChunk fills buf from r. Only the last chunk of the data will be short,
+// and we never return an empty chunk, since readers are allowed to return
+// zero bytes without an error and empty messages would pollute the stream.
+func readChunk(r io.Reader, buf []byte, follow <-chan struct{}) (int, error) {
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			return n, err
+		}
+		if err != io.EOF || follow == nil {
+			return 0, err
+		}
+		select {
+		case <-follow:
+			return 0, io.EOF
+		case <-time.After(followPollInterval):
+		}
+	}
+}
+
+// recycle returns a chunk's buffer once the caller is done with it.
+func (cr *chunkReader) recycle(chunk []byte) {
+	cr.free <- chunk[:cap(chunk)]
+}
@@ -0,0 +1,85 @@
+package xfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// stutterReader returns (0, nil) on every other read, and otherwise at most
+// max bytes, as some readers, such as those of pipes and sockets, may.
+type stutterReader struct {
+	r     io.Reader
+	max   int
+	reads int
+}
+
+func (sr *stutterReader) Read(p []byte) (int, error) {
+	sr.reads++
+	if sr.reads%2 == 1 {
+		return 0, nil
+	}
+	if len(p) > sr.max {
+		p = p[:sr.max]
+	}
+	return sr.r.Read(p)
+}
+
+func TestReadChunkZeroReads(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	sr := &stutterReader{r: bytes.NewReader(data), max: 7}
+	buf := make([]byte, 64)
+	var got []byte
+	for {
+		n, err := readChunk(sr, buf, nil)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading chunk: %v", err)
+		}
+		if n == 0 {
+			t.Fatalf("Read an empty chunk")
+		}
+		// Only the last chunk is short.
+		if n < len(buf) && len(got)+n != len(data) {
+			t.Fatalf("Read a short chunk of %d bytes at offset %d", n, len(got))
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Read %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
+
+func TestChunkReaderZeroReads(t *testing.T) {
+	for _, size := range []int{0, 1, 64, 1000, 1024} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		cr := newChunkReader(&stutterReader{r: bytes.NewReader(data), max: 5}, 64, nil)
+		var got []byte
+		chunks := 0
+		for chunk := range cr.chunks {
+			if len(chunk) == 0 {
+				t.Fatalf("Size %d: read an empty chunk", size)
+			}
+			got = append(got, chunk...)
+			chunks++
+			cr.recycle(chunk)
+		}
+		if cr.err != nil {
+			t.Fatalf("Size %d: error reading: %v", size, cr.err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Size %d: read %d bytes that differ", size, len(got))
+		}
+		if want := (size + 63) / 64; chunks != want {
+			t.Fatalf("Size %d: read %d chunks, expected %d", size, chunks, want)
+		}
+		sum := sha256.Sum256(data)
+		if cr.digest() != hex.EncodeToString(sum[:]) {
+			t.Fatalf("Size %d: digest %s does not match the data", size, cr.digest())
+		}
+		cr.close()
+	}
+}
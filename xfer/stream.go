@@ -0,0 +1,210 @@
+package xfer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// LookupStream retrieves the stream info, retrying with backoff on transient errors
+// such as those seen while we are reconnecting.
+func LookupStream(js nats.JetStreamContext, stream string) (*nats.StreamInfo, error) {
+	const maxAttempts = 5
+	delay := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		si, err := js.StreamInfo(stream)
+		if err == nil {
+			return si, nil
+		}
+		// The server reports a missing stream with this description.
+		if isNotFound(err) {
+			return nil, ErrStreamNotFound
+		}
+		if !isTransient(err) || attempt == maxAttempts {
+			return nil, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isNotFound reports whether the error is the server's for a missing stream.
+func isNotFound(err error) bool {
+	return err != nil && err.Error() == ErrStreamNotFound.Error()
+}
+
+// isTransient reports whether the error is likely to clear up on a retry.
+func isTransient(err error) bool {
+	switch err {
+	case nats.ErrTimeout, nats.ErrNoResponders, nats.ErrConnectionReconnecting,
+		nats.ErrDisconnected, context.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// checkExistingStream makes sure a stream created ahead of time, e.g. by an
+// operator, can hold our transfer. It must be empty, so we do not mix our
+// chunks with unrelated data, and configured so none of them are lost.
+func checkExistingStream(si *nats.StreamInfo, chunkSize int) error {
+	cfg := &si.Config
+	switch {
+	case si.State.Msgs > 0:
+		return fmt.Errorf("existing stream %q is not empty, it has %d messages", cfg.Name, si.State.Msgs)
+	case len(cfg.Subjects) != 1 || strings.ContainsAny(cfg.Subjects[0], "*>"):
+		return fmt.Errorf("existing stream %q must have a single subject without wildcards", cfg.Name)
+	case cfg.Mirror != nil:
+		return fmt.Errorf("existing stream %q is a mirror", cfg.Name)
+	case cfg.Retention != nats.LimitsPolicy:
+		return fmt.Errorf("existing stream %q must use limits retention so chunks are kept", cfg.Name)
+	case cfg.MaxMsgSize > 0 && int(cfg.MaxMsgSize) < chunkSize+ChunkHeaderRoom:
+		return fmt.Errorf("existing stream %q has a maximum message size of %d, too small for our chunks", cfg.Name, cfg.MaxMsgSize)
+	}
+	return nil
+}
+
+// placementInfo describes where a stream was placed, or warns that placement
+// had no effect because JetStream is not clustered.
+func placementInfo(si *nats.StreamInfo) string {
+	if si.Cluster == nil || si.Cluster.Name == "" {
+		return fmt.Sprintf("Warning: JetStream is not clustered, ignoring placement for stream %q", si.Config.Name)
+	}
+	peers := []string{si.Cluster.Leader}
+	for _, pi := range si.Cluster.Replicas {
+		peers = append(peers, pi.Name)
+	}
+	return fmt.Sprintf("Stream %q placed in cluster %q on %s", si.Config.Name, si.Cluster.Name, strings.Join(peers, ", "))
+}
+
+// waitForReplicas waits for every replica of the stream to have caught up
+// with the leader. This makes sure a leader failover can not lose the
+// transfer, at the cost of waiting on the slowest replica.
+func waitForReplicas(js nats.JetStreamContext, stream string) error {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		si, err := js.StreamInfo(stream)
+		if err != nil {
+			return fmt.Errorf("error checking stream replicas: %v", err)
+		}
+		if replicasCurrent(si) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for stream %q replicas to be current", stream)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// replicasCurrent reports whether all replicas of the stream are current.
+func replicasCurrent(si *nats.StreamInfo) bool {
+	if si.Config.Replicas <= 1 {
+		return true
+	}
+	if si.Cluster == nil || len(si.Cluster.Replicas) < si.Config.Replicas-1 {
+		return false
+	}
+	for _, pi := range si.Cluster.Replicas {
+		if !pi.Current || pi.Offline || pi.Lag > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// When the chunks of a stream expire, we want to have retrieved them well
+// before the oldest one goes. We allow expiryChunkTime for each message,
+// and no less than expiryMargin overall.
+const (
+	expiryChunkTime = 10 * time.Millisecond
+	expiryMargin    = time.Minute
+)
+
+// checkExpiry warns when a stream with a maximum age may lose its oldest
+// chunks before we can retrieve all of its messages.
+func checkExpiry(si *nats.StreamInfo, logf func(format string, args ...interface{})) {
+	if si.Config.MaxAge <= 0 || si.State.Msgs == 0 {
+		return
+	}
+	left := si.Config.MaxAge - time.Since(si.State.FirstTime)
+	need := time.Duration(si.State.Msgs) * expiryChunkTime
+	if need < expiryMargin {
+		need = expiryMargin
+	}
+	if left <= 0 {
+		logf("Warning: the chunks of stream %q are expiring, it has a maximum age of %v", si.Config.Name, si.Config.MaxAge)
+	} else if left < need {
+		logf("Warning: the oldest chunks of stream %q expire in %v, which may be too soon to retrieve its %d messages",
+			si.Config.Name, left.Round(time.Second), si.State.Msgs)
+	}
+}
+
+// chunksGone returns an error if the chunk at seq is no longer in the
+// stream, having expired or been purged or removed, since retrying can not
+// recover it.
+func chunksGone(js nats.JetStreamContext, stream string, seq uint64) error {
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		return nil
+	}
+	if err := purged(si, seq); err != nil {
+		return err
+	}
+	if _, err := js.GetMsg(stream, seq); isNoMessage(err) {
+		return integrityErrorf("chunk at sequence %d of %q was removed from the stream", seq, stream)
+	}
+	return nil
+}
+
+// firstChunkFirst reports whether the first message in the stream is the
+// first chunk of the file, by its index.
+func firstChunkFirst(js nats.JetStreamContext, si *nats.StreamInfo) bool {
+	m, err := js.GetMsg(si.Config.Name, si.State.FirstSeq)
+	return err == nil && HeaderInt(m.Header, HeaderChunkIndex) == 0
+}
+
+// purged returns an error if messages of the stream from seq on are no
+// longer in it because they expired or were purged.
+func purged(si *nats.StreamInfo, seq uint64) error {
+	if si.State.FirstSeq <= seq {
+		return nil
+	}
+	stream := si.Config.Name
+	if si.Config.MaxAge > 0 {
+		return integrityErrorf("chunks of %q from sequence %d have expired, the stream has a maximum age of %v", stream, seq, si.Config.MaxAge)
+	}
+	return integrityErrorf("chunks of %q from sequence %d are no longer in the stream", stream, seq)
+}
+
+// isNoMessage reports whether the error is the server's for a message
+// that is not in the stream.
+func isNoMessage(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no message found")
+}
+
+// debugConsumer reports the configuration of the consumer behind sub, when
+// debugf is set.
+func debugConsumer(sub *nats.Subscription, debugf func(format string, args ...interface{})) {
+	if debugf == nil {
+		return
+	}
+	ci, err := sub.ConsumerInfo()
+	if err != nil {
+		debugf("Error looking up consumer: %v", err)
+		return
+	}
+	debugf("Created consumer %q with %s", ci.Name, configJSON(ci.Config))
+}
+
+// configJSON formats a stream or consumer configuration for a log line.
+func configJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,256 @@
+package xfer
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// A directory can also be transferred as a tar archive, which is stored like
+// any other file but marked with TypeTar. The archive is written as it is
+// published, so nothing is staged on disk or held in memory. Its entries are
+// below a directory named after the top of the tree, as tar would write them,
+// and carry their modes and modification times.
+
+// PutTar stores the tree below root in a new stream as a tar archive, named
+// after root with a .tar extension unless opts.Name is set. Following,
+// appending and parallel puts are not supported. Like Put it stops once ctx
+// is done.
+func PutTar(ctx context.Context, js nats.JetStreamContext, root string, opts PutOptions) (*Result, error) {
+	if opts.Follow != nil || opts.Append || opts.Parallel > 1 {
+		return nil, fmt.Errorf("%q is put as a tar archive, which can not be followed, appended to or put in parallel", root)
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", root)
+	}
+	top := filepath.Base(root)
+	if opts.Name == "" {
+		opts.Name = top + ".tar"
+	}
+	entries, err := walkDir(root, opts.FollowSymlinks, func(format string, args ...interface{}) {
+		logf(opts.Logf, format, args...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %q: %v", root, err)
+	}
+	p, err := newPutter(ctx, js, &opts)
+	if err != nil {
+		return nil, err
+	}
+	// The size of the archive is only known at the end.
+	p.pr = newProgressReporter(opts.Progress, 0, -1)
+
+	pr, pw := io.Pipe()
+	files := make(chan int, 1)
+	go func() {
+		n, err := writeTar(pw, top, fi, entries)
+		files <- n
+		pw.CloseWithError(err)
+	}()
+	digest, err := p.sendFile(pr, opts.Name, -1)
+	// Stops the archive being written if we could not send it.
+	pr.CloseWithError(err)
+	if err != nil {
+		return nil, err
+	}
+	p.res.Files = <-files
+
+	tm := &Meta{Name: opts.Name, Digest: digest, ModTime: fi.ModTime(), Tar: true}
+	p.describe(tm, nil)
+	return p.finish(tm)
+}
+
+// writeTar writes the archive of the entries below top, whose info is fi,
+// returning the number of files in it.
+func writeTar(w io.Writer, top string, fi os.FileInfo, entries []dirEntry) (int, error) {
+	tw := tar.NewWriter(w)
+	// PAX keeps modification times to the nanosecond.
+	header := func(name string, fi os.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, hdr.Format = name, tar.FormatPAX
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		return tw.WriteHeader(hdr)
+	}
+	if err := header(top, fi); err != nil {
+		return 0, err
+	}
+	files := 0
+	for i := range entries {
+		de := &entries[i]
+		if err := header(path.Join(top, de.path), de.fi); err != nil {
+			return files, err
+		}
+		if de.fi.IsDir() {
+			continue
+		}
+		fd, err := os.Open(de.src)
+		if err != nil {
+			return files, err
+		}
+		_, err = io.CopyN(tw, fd, de.fi.Size())
+		fd.Close()
+		if err == io.EOF {
+			return files, fmt.Errorf("%q changed size during the transfer", de.src)
+		} else if err != nil {
+			return files, err
+		}
+		files++
+	}
+	return files, tw.Close()
+}
+
+// GetTar retrieves a directory put with PutTar, extracting the archive as
+// dest, which must not exist. Following, windows and resuming are not
+// supported. Like Get it stops once ctx is done, leaving dest as it is.
+func GetTar(ctx context.Context, js nats.JetStreamContext, dest string, opts GetOptions) (*Result, error) {
+	si, tm, err := lookupTransfer(js, opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	stream := si.Config.Name
+	if tm == nil || !tm.Tar {
+		return nil, fmt.Errorf("stream %q does not hold a tar archive", stream)
+	}
+	if opts.Follow || opts.SinceSeq > 0 || opts.UntilSeq > 0 || opts.Offset > 0 || opts.Length > 0 || opts.Resume != nil {
+		return nil, fmt.Errorf("stream %q holds a tar archive, which can not be extracted when following, windowed or resumed", stream)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("destination directory %w: %s", ErrExists, dest)
+	}
+
+	pr, pw := io.Pipe()
+	fr := &failReader{r: pr}
+	done := make(chan error, 1)
+	var files int
+	go func() {
+		var err error
+		files, err = extractTar(fr, dest, opts.Sync, opts.Logf)
+		// Get fails to write once we stop reading, so stop it too.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	res, err := Get(ctx, js, pw, opts)
+	pw.CloseWithError(err)
+	xerr := <-done
+	// Whichever of us failed first has the error that explains it.
+	if err != nil && (xerr == nil || fr.err != nil) {
+		return nil, err
+	} else if xerr != nil {
+		return nil, xerr
+	}
+	res.Files = files
+	return res, nil
+}
+
+// failReader remembers the first error reading from r, other than io.EOF.
+type failReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err != nil && err != io.EOF && fr.err == nil {
+		fr.err = err
+	}
+	return n, err
+}
+
+// extractTar recreates the tree in the archive as dest, returning the number
+// of files. Its entries are below a single top directory, which becomes dest.
+// Anything other than directories and regular files is skipped. The rest of
+// r is read once the archive ends.
+func extractTar(r io.Reader, dest string, sync bool, f func(format string, args ...interface{})) (int, error) {
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return 0, fmt.Errorf("error creating directory: %v", err)
+	}
+	var dirs []dirAttrs
+	files := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, fmt.Errorf("error reading archive: %v", err)
+		}
+		// The top directory is dest itself.
+		name := strings.TrimSuffix(hdr.Name, "/")
+		rel := ""
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			rel = name[i+1:]
+		}
+		mode, mtime := os.FileMode(hdr.Mode).Perm(), hdr.ModTime
+		if rel == "" && hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirAttrs{dest, mode, mtime})
+			continue
+		}
+		p, err := localPath(dest, rel)
+		if err != nil {
+			return files, fmt.Errorf("error in archive entry %q: %v", hdr.Name, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(p, 0700); err != nil {
+				return files, fmt.Errorf("error creating directory: %v", err)
+			}
+			dirs = append(dirs, dirAttrs{p, mode, mtime})
+		case tar.TypeReg:
+			if err := extractFile(tr, p, mode, sync); err != nil {
+				return files, err
+			}
+			// Files are created with their mode, less the umask, so set it again.
+			if err := RestoreMode(p, mode); err != nil {
+				logf(f, "Error setting mode of %q: %v", p, err)
+			}
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				logf(f, "Error setting modification time of %q: %v", p, err)
+			}
+			files++
+		default:
+			logf(f, "Skipping %q, not a directory or regular file", hdr.Name)
+		}
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return files, fmt.Errorf("error reading archive: %v", err)
+	}
+	restoreDirs(dirs, f)
+	return files, nil
+}
+
+// extractFile writes the contents of the current entry of tr to a new file.
+func extractFile(tr *tar.Reader, p string, mode os.FileMode, sync bool) error {
+	fd, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer fd.Close()
+	if _, err := io.Copy(fd, tr); err != nil {
+		return fmt.Errorf("error extracting %q: %v", p, err)
+	}
+	if sync {
+		if err := fd.Sync(); err != nil {
+			return fmt.Errorf("error syncing file: %v", err)
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
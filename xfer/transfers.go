@@ -0,0 +1,143 @@
+package xfer
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// TransferInfo describes a transfer stored in a stream.
+type TransferInfo struct {
+	// Stream is the name of the stream holding the transfer.
+	Stream string
+	// Name is the original name of the file.
+	Name string
+	// Size is the size of the file in bytes.
+	Size int64
+	// ChunkSize is the size of the chunks the file was split into.
+	ChunkSize int
+	// Digest is the hex encoded SHA-256 digest of the file.
+	Digest string
+	// Created is when the stream was created.
+	Created time.Time
+	// Msgs and Bytes are what the stream holds on the server.
+	Msgs  uint64
+	Bytes uint64
+	// Meta holds all of the metadata for the transfer, keyed by the lower
+	// cased header name without the "Njs-Xfer-" prefix, e.g. "name" or "size".
+	Meta map[string]string
+	// InProgress is set for transfers that do not have their trailer yet, such
+	// as a put that is still running or was interrupted. Their name, size and
+	// digest are not known, and they only match filters without Meta.
+	InProgress bool
+}
+
+// Filter selects which transfers ListTransfers returns.
+// The zero value matches all transfers.
+type Filter struct {
+	// Prefix, if set, must prefix the stream name.
+	Prefix string
+	// Meta, if set, must all match the transfer's metadata.
+	Meta map[string]string
+}
+
+func (f *Filter) matches(ti *TransferInfo) bool {
+	if !strings.HasPrefix(ti.Stream, f.Prefix) {
+		return false
+	}
+	for k, v := range f.Meta {
+		if ti.Meta[strings.ToLower(k)] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ListTransfers scans the streams in the account and returns those created by
+// njs-xfer that match the filter, sorted by stream name. Streams are ours if
+// they end with our trailer, or while in progress if their first message is
+// one of our chunks. Anything else is skipped.
+func ListTransfers(js nats.JetStreamContext, filter Filter) ([]TransferInfo, error) {
+	var tis []TransferInfo
+	for si := range js.StreamsInfo() {
+		if !strings.HasPrefix(si.Config.Name, filter.Prefix) {
+			continue
+		}
+		if si.State.Msgs == 0 {
+			continue
+		}
+		// A stream we can not read, e.g. because its last message was
+		// deleted, is skipped like one that is not ours.
+		m, err := js.GetMsg(si.Config.Name, si.State.LastSeq)
+		if err != nil {
+			continue
+		}
+		tm, err := ParseMeta(m.Header)
+		if err != nil {
+			continue
+		}
+		if tm == nil {
+			if ours, err := isChunkStream(js, si); err == nil && ours {
+				ti := TransferInfo{
+					Stream:     si.Config.Name,
+					Created:    si.Created,
+					Msgs:       si.State.Msgs,
+					Bytes:      si.State.Bytes,
+					Meta:       make(map[string]string),
+					InProgress: true,
+				}
+				if filter.matches(&ti) {
+					tis = append(tis, ti)
+				}
+			}
+			continue
+		}
+		ti := TransferInfo{
+			Stream:    si.Config.Name,
+			Name:      tm.Name,
+			Size:      tm.Size,
+			ChunkSize: tm.ChunkSize,
+			Digest:    tm.Digest,
+			Created:   si.Created,
+			Msgs:      si.State.Msgs,
+			Bytes:     si.State.Bytes,
+			Meta:      make(map[string]string),
+		}
+		for k := range m.Header {
+			if strings.HasPrefix(k, HeaderPrefix) {
+				ti.Meta[strings.ToLower(strings.TrimPrefix(k, HeaderPrefix))] = m.Header.Get(k)
+			}
+		}
+		if filter.matches(&ti) {
+			tis = append(tis, ti)
+		}
+	}
+	sort.Slice(tis, func(i, j int) bool { return tis[i].Stream < tis[j].Stream })
+	return tis, nil
+}
+
+// isChunkStream reports whether the stream's first message is one of our
+// chunks, or a directory entry, which always carry our headers.
+func isChunkStream(js nats.JetStreamContext, si *nats.StreamInfo) (bool, error) {
+	m, err := js.GetMsg(si.Config.Name, si.State.FirstSeq)
+	if err != nil {
+		return false, err
+	}
+	return m.Header.Get(HeaderChunkIndex) != "" || m.Header.Get(HeaderEntry) != "", nil
+}
+
+// IsTransfer reports whether the stream holds a transfer made by njs-xfer,
+// complete or not, rather than unrelated data.
+func IsTransfer(js nats.JetStreamContext, si *nats.StreamInfo) (bool, error) {
+	if si.State.Msgs == 0 {
+		return false, nil
+	}
+	if tm, err := LookupMeta(js, si); err != nil {
+		return false, err
+	} else if tm != nil {
+		return true, nil
+	}
+	return isChunkStream(js, si)
+}
@@ -0,0 +1,33 @@
+package xfer
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestListTransfersSkipsUnreadable(t *testing.T) {
+	_, js := runServer(t)
+	path, _ := randomFile(t, "listed.bin", 100)
+	putFile(t, js, "listed", path, PutOptions{})
+	// A stream whose last message was deleted can not be read at its last
+	// sequence.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "unreadable", Subjects: []string{"unreadable"}}); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := js.Publish("unreadable", []byte("data")); err != nil {
+			t.Fatalf("Error publishing: %v", err)
+		}
+	}
+	if err := js.DeleteMsg("unreadable", 2); err != nil {
+		t.Fatalf("Error deleting message: %v", err)
+	}
+	tis, err := ListTransfers(js, Filter{})
+	if err != nil {
+		t.Fatalf("Error listing transfers: %v", err)
+	}
+	if len(tis) != 1 || tis[0].Stream != "listed" {
+		t.Fatalf("Expected only the transfer in %q, got %+v", "listed", tis)
+	}
+}
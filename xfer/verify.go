@@ -0,0 +1,93 @@
+package xfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// setChunkCRC records the length and checksum of a chunk's stored data.
+func setChunkCRC(hdr http.Header, data []byte) {
+	hdr.Set(HeaderChunkLength, strconv.Itoa(len(data)))
+	hdr.Set(HeaderChunkCRC, fmt.Sprintf("%08x", crc32.Checksum(data, crcTable)))
+}
+
+// checkChunkCRC checks a chunk's stored data against its length and
+// checksum, if it has them, which chunks from older versions do not.
+func checkChunkCRC(hdr http.Header, data []byte) error {
+	if l := HeaderInt(hdr, HeaderChunkLength); l >= 0 && l != len(data) {
+		return integrityErrorf("chunk is %d bytes but should be %d", len(data), l)
+	}
+	if want := hdr.Get(HeaderChunkCRC); want != "" {
+		if got := fmt.Sprintf("%08x", crc32.Checksum(data, crcTable)); got != want {
+			return integrityErrorf("chunk is corrupt, its CRC-32C is %s but should be %s", got, want)
+		}
+	}
+	return nil
+}
+
+// digestVerifier hashes chunks as they arrive in its own go routine so that
+// verification overlaps with receiving and writing the file. This avoids a
+// second pass over the reconstructed file once the transfer completes.
+type digestVerifier struct {
+	h    hash.Hash
+	ch   chan []byte
+	done chan struct{}
+	// hashed is how long was spent hashing, valid once sum returns.
+	hashed time.Duration
+}
+
+func newDigestVerifier() *digestVerifier {
+	dv := &digestVerifier{
+		h:    sha256.New(),
+		ch:   make(chan []byte, 64),
+		done: make(chan struct{}),
+	}
+	go func() {
+		for data := range dv.ch {
+			start := time.Now()
+			dv.h.Write(data)
+			dv.hashed += time.Since(start)
+		}
+		close(dv.done)
+	}()
+	return dv
+}
+
+// add queues a chunk to be hashed. Chunks must be added in order.
+// The chunk must not be modified after being added.
+func (dv *digestVerifier) add(data []byte) {
+	dv.ch <- data
+}
+
+// addFrom hashes the first n bytes from r, e.g. a partial file being resumed.
+func (dv *digestVerifier) addFrom(r io.Reader, n int64) error {
+	for n > 0 {
+		buf := make([]byte, 64*1024)
+		if int64(len(buf)) > n {
+			buf = buf[:n]
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		dv.add(buf)
+		n -= int64(len(buf))
+	}
+	return nil
+}
+
+// sum waits for any outstanding chunks to be hashed and returns the hex
+// encoded digest.
+func (dv *digestVerifier) sum() string {
+	close(dv.ch)
+	<-dv.done
+	return hex.EncodeToString(dv.h.Sum(nil))
+}
@@ -0,0 +1,136 @@
+package xfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// chunkWriterDepth is how many chunks may be queued ahead of the writer.
+const chunkWriterDepth = 64
+
+// chunkWriter writes chunks to a writer in its own go routine, so writing
+// to disk overlaps with receiving the next chunks. Chunks are written in the
+// order they are queued. Once a write fails the rest are discarded, and the
+// error is returned by the next call.
+type chunkWriter struct {
+	chunks   chan queuedChunk
+	done     chan struct{}
+	pending  sync.WaitGroup
+	progress func(n int)
+	mu       sync.Mutex
+	err      error
+	queued   int
+	closed   bool
+}
+
+// queuedChunk is a chunk waiting to be written, with what to call once it is.
+type queuedChunk struct {
+	data    []byte
+	written func()
+}
+
+// newChunkWriter starts writing chunks to w, calling progress, if set, with
+// the size of each once it is written.
+func newChunkWriter(w io.Writer, progress func(n int)) *chunkWriter {
+	cw := &chunkWriter{
+		chunks:   make(chan queuedChunk, chunkWriterDepth),
+		done:     make(chan struct{}),
+		progress: progress,
+	}
+	go func() {
+		defer close(cw.done)
+		for qc := range cw.chunks {
+			if cw.error() == nil {
+				if err := writeFull(w, qc.data); err != nil {
+					cw.setError(err)
+				} else {
+					if cw.progress != nil {
+						cw.progress(len(qc.data))
+					}
+					if qc.written != nil {
+						qc.written()
+					}
+				}
+			}
+			cw.mu.Lock()
+			cw.queued--
+			cw.mu.Unlock()
+			cw.pending.Done()
+		}
+	}()
+	return cw
+}
+
+// writeFull writes all of data to w, treating a short write as an error
+// even if w does not report one.
+func writeFull(w io.Writer, data []byte) error {
+	n, err := w.Write(data)
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return fmt.Errorf("error writing: %v (wrote %d of %d bytes)", err, n, len(data))
+	}
+	return nil
+}
+
+func (cw *chunkWriter) error() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.err
+}
+
+func (cw *chunkWriter) setError(err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.err = err
+}
+
+// write queues a chunk, waiting for room unless ctx is done. The chunk must
+// not be modified afterwards. Once it is written, written is called if set,
+// from the writer's go routine, but not if the write failed.
+func (cw *chunkWriter) write(ctx context.Context, data []byte, written func()) error {
+	if err := cw.error(); err != nil {
+		return err
+	}
+	cw.pending.Add(1)
+	cw.mu.Lock()
+	cw.queued++
+	cw.mu.Unlock()
+	select {
+	case cw.chunks <- queuedChunk{data, written}:
+		return nil
+	case <-ctx.Done():
+		cw.mu.Lock()
+		cw.queued--
+		cw.mu.Unlock()
+		cw.pending.Done()
+		return ctx.Err()
+	}
+}
+
+// busy reports whether chunks are still waiting to be written.
+func (cw *chunkWriter) busy() bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.queued > 0
+}
+
+// flush waits for every queued chunk to be written.
+func (cw *chunkWriter) flush() error {
+	cw.pending.Wait()
+	return cw.error()
+}
+
+// close writes what is queued and stops the writer. It is safe to call
+// more than once.
+func (cw *chunkWriter) close() error {
+	if !cw.closed {
+		cw.closed = true
+		close(cw.chunks)
+	}
+	<-cw.done
+	return cw.error()
+}
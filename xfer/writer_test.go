@@ -0,0 +1,25 @@
+package xfer
+
+import (
+	"io"
+	"testing"
+)
+
+// shortWriter writes at most max bytes without reporting an error.
+type shortWriter struct {
+	max int
+}
+
+func (sw shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.max {
+		return sw.max, nil
+	}
+	return len(p), nil
+}
+
+func TestWriteFullShort(t *testing.T) {
+	err := writeFull(shortWriter{max: 3}, []byte("hello"))
+	if want := "error writing: " + io.ErrShortWrite.Error() + " (wrote 3 of 5 bytes)"; err == nil || err.Error() != want {
+		t.Fatalf("Expected %q, got %v", want, err)
+	}
+}
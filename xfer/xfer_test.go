@@ -0,0 +1,250 @@
+package xfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runServer starts an embedded server with JetStream, returning a
+// JetStream context connected to it. Both are shut down with the test.
+func runServer(t testing.TB) (*nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("Server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("Error creating JetStream context: %v", err)
+	}
+	return nc, js
+}
+
+// randomFile writes size random bytes to a file named name in a temporary
+// directory, returning its path and contents.
+func randomFile(t testing.TB, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Error writing %q: %v", path, err)
+	}
+	return path, data
+}
+
+// putFile puts the file at path into stream with opts.
+func putFile(t testing.TB, js nats.JetStreamContext, stream, path string, opts PutOptions) *Result {
+	t.Helper()
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening %q: %v", path, err)
+	}
+	defer fd.Close()
+	opts.Stream, opts.Name = stream, filepath.Base(path)
+	res, err := Put(context.Background(), js, fd, opts)
+	if err != nil {
+		t.Fatalf("Error putting %q: %v", path, err)
+	}
+	return res
+}
+
+// getBytes retrieves stream with opts.
+func getBytes(t *testing.T, js nats.JetStreamContext, stream string, opts GetOptions) ([]byte, *Result) {
+	t.Helper()
+	var buf bytes.Buffer
+	opts.Stream = stream
+	res, err := Get(context.Background(), js, &buf, opts)
+	if err != nil {
+		t.Fatalf("Error getting %q: %v", stream, err)
+	}
+	return buf.Bytes(), res
+}
+
+func TestRoundTrip(t *testing.T) {
+	_, js := runServer(t)
+	const cs = 1024
+	for _, tc := range []struct {
+		name      string
+		size      int
+		chunkSize int
+	}{
+		{"small", 100, cs},
+		{"empty", 0, cs},
+		{"boundary", 4 * cs, cs},
+		{"past_boundary", 4*cs + 1, cs},
+		{"large", 5*DefaultChunkSize + 123, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, data := randomFile(t, tc.name+".bin", tc.size)
+			pres := putFile(t, js, tc.name, path, PutOptions{ChunkSize: tc.chunkSize})
+			if pres.Bytes != int64(tc.size) {
+				t.Fatalf("Put reported %d bytes, expected %d", pres.Bytes, tc.size)
+			}
+			got, gres := getBytes(t, js, tc.name, GetOptions{})
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+			}
+			if gres.Bytes != int64(tc.size) {
+				t.Fatalf("Get reported %d bytes, expected %d", gres.Bytes, tc.size)
+			}
+			cs := tc.chunkSize
+			if cs == 0 {
+				cs = DefaultChunkSize
+			}
+			if chunks := (tc.size + cs - 1) / cs; gres.Chunks != chunks {
+				t.Fatalf("Get reported %d chunks, expected %d", gres.Chunks, chunks)
+			}
+			if gres.Meta == nil || gres.Meta.Size != int64(tc.size) || gres.Meta.Name != tc.name+".bin" {
+				t.Fatalf("Unexpected metadata %+v", gres.Meta)
+			}
+		})
+	}
+}
+
+func TestPullRoundTrip(t *testing.T) {
+	_, js := runServer(t)
+	path, data := randomFile(t, "pull.bin", 50*1024+7)
+	putFile(t, js, "pull", path, PutOptions{ChunkSize: 1024})
+	got, res := getBytes(t, js, "pull", GetOptions{Mode: ConsumerPull, MaxAckPending: 8})
+	if !bytes.Equal(got, data) || res.Bytes != int64(len(data)) {
+		t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+	}
+}
+
+// droppingSource loses the messages at the given stream sequences the
+// first time they are delivered, like a consumer that was overrun.
+type droppingSource struct {
+	chunkSource
+	drop map[uint64]bool
+}
+
+func (ds *droppingSource) next(ctx context.Context, timeout time.Duration) (*nats.Msg, error) {
+	for {
+		m, err := ds.chunkSource.next(ctx, timeout)
+		if err != nil {
+			return m, err
+		}
+		meta, err := m.Metadata()
+		if err != nil || !ds.drop[meta.Sequence.Stream] {
+			return m, nil
+		}
+		delete(ds.drop, meta.Sequence.Stream)
+	}
+}
+
+// dropChunks makes Get lose the messages at seqs once each until the test ends.
+func dropChunks(t *testing.T, seqs ...uint64) {
+	drop := make(map[uint64]bool)
+	for _, seq := range seqs {
+		drop[seq] = true
+	}
+	newChunkSource = func(js nats.JetStreamContext, stream, subj string, seq uint64, opts GetOptions) (chunkSource, error) {
+		src, err := openChunkSource(js, stream, subj, seq, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &droppingSource{src, drop}, nil
+	}
+	t.Cleanup(func() { newChunkSource = openChunkSource })
+}
+
+func TestGapRecovery(t *testing.T) {
+	_, js := runServer(t)
+	path, data := randomFile(t, "gap.bin", 20*1024)
+	putFile(t, js, "gap", path, PutOptions{ChunkSize: 1024})
+
+	for _, mode := range []string{ConsumerFlow, ConsumerPull} {
+		t.Run(mode, func(t *testing.T) {
+			dropChunks(t, 3, 11)
+			got, res := getBytes(t, js, "gap", GetOptions{Mode: mode})
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Retrieved %d bytes that differ from the %d put", len(got), len(data))
+			}
+			if res.Gaps != 2 {
+				t.Fatalf("Recovered from %d gaps, expected 2", res.Gaps)
+			}
+		})
+	}
+
+	t.Run("no_recover", func(t *testing.T) {
+		dropChunks(t, 5)
+		_, err := Get(context.Background(), js, &bytes.Buffer{}, GetOptions{Stream: "gap", NoRecover: true})
+		if !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected an integrity error, got %v", err)
+		}
+	})
+	t.Run("max_gap_retries", func(t *testing.T) {
+		dropChunks(t, 3, 11)
+		_, err := Get(context.Background(), js, &bytes.Buffer{}, GetOptions{Stream: "gap", MaxGapRetries: 1})
+		if !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected an integrity error, got %v", err)
+		}
+	})
+}
+
+func TestStreamExists(t *testing.T) {
+	_, js := runServer(t)
+	path, _ := randomFile(t, "exists.bin", 100)
+	putFile(t, js, "exists", path, PutOptions{})
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	_, err = Put(context.Background(), js, fd, PutOptions{Stream: "exists", Name: "exists.bin"})
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected %v, got %v", ErrExists, err)
+	}
+}
+
+func TestDestinationExists(t *testing.T) {
+	_, js := runServer(t)
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PutDir(context.Background(), js, root, PutOptions{Stream: "dir"}); err != nil {
+		t.Fatalf("Error putting directory: %v", err)
+	}
+	dest := t.TempDir()
+	_, err := GetDir(context.Background(), js, dest, GetOptions{Stream: "dir"})
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected %v, got %v", ErrExists, err)
+	}
+	// Into a new directory it works.
+	dest = filepath.Join(dest, "new")
+	if _, err := GetDir(context.Background(), js, dest, GetOptions{Stream: "dir"}); err != nil {
+		t.Fatalf("Error getting directory: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dest, "f")); err != nil || string(data) != "hello" {
+		t.Fatalf("Unexpected contents %q, %v", data, err)
+	}
+}